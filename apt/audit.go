@@ -0,0 +1,93 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// auditEntry is a line of the Audit-Log, recording a file apt fetched.
+type auditEntry struct {
+	Timestamp string `json:"timestamp"`
+	URI       string `json:"uri"`
+	// Host is the host which finally served the file, after any redirects
+	// or mirrors, or empty if it came from the download cache.
+	Host     string `json:"host"`
+	Status   int    `json:"status"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+	IMSHit   bool   `json:"ims_hit"`
+	CacheHit bool   `json:"cache_hit,omitempty"`
+	// Principal is the identity the file was fetched as, or empty if it came
+	// from the download cache, which needs no credentials.
+	Principal string `json:"principal,omitempty"`
+}
+
+// recordsPrincipal reports whether the principal is recorded anywhere, and so
+// worth asking the metadata server for.
+func (c *aptMethodConfig) recordsPrincipal() bool {
+	return c.auditLog != "" || c.logFile != "" || c.traceEndpoint != ""
+}
+
+// writeAudit appends an entry for the acquire of `uri` described by `rec` to
+// the Audit-Log, if one is configured. Acquires which got no file, or no
+// answer about one, are not recorded.
+func (m *Method) writeAudit(uri string, rec *acquireRecord) error {
+	path := m.config.auditLog
+	if path == "" || !rec.cacheHit && rec.status != http.StatusOK && rec.status != http.StatusNotModified {
+		return nil
+	}
+	entry := auditEntry{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		URI:       uri,
+		Host:      rec.host,
+		Status:    rec.status,
+		Size:      rec.bytes,
+		SHA256:    rec.sha256,
+		IMSHit:    rec.status == http.StatusNotModified,
+		CacheHit:  rec.cacheHit,
+		Principal: m.principal,
+	}
+	if rec.cacheHit {
+		entry.Status, entry.Principal = http.StatusOK, ""
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return appendLine(path, append(line, '\n'))
+}
+
+// appendLine appends `line` to the file at `path` in a single write, holding
+// an exclusive lock so that lines from concurrent apt runs don't interleave.
+func appendLine(path string, line []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer f.Close()
+	if err := lockFile(f, true); err != nil {
+		return fmt.Errorf("failed to lock audit log: %v", err)
+	}
+	defer unlockFile(f)
+	if _, err := f.Write(line); err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	return nil
+}
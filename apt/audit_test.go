@@ -0,0 +1,239 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/oauth2/google"
+)
+
+// readAuditLog returns the entries of the audit log at `path`.
+func readAuditLog(t *testing.T, path string) []auditEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []auditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("failed, invalid entry %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestHandleAcquireAudit(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "Packages")
+	writeTestFile(t, existing, "unchanged")
+
+	var tests = []struct {
+		client   httpClient
+		filename string
+		expected *auditEntry
+	}{
+		{
+			fakeHTTPClient{},
+			"/path/to/file",
+			&auditEntry{Host: "fake.uri", Status: 200, Size: 200, SHA256: "JKLMNOPQR"},
+		},
+		{
+			fakeHTTPClient{code: 304},
+			existing,
+			&auditEntry{Host: "fake.uri", Status: 304, Size: 9, SHA256: sha256Hex("unchanged"), IMSHit: true},
+		},
+		{
+			fakeHTTPClient{code: 404},
+			"/path/to/file",
+			nil,
+		},
+	}
+	for i, tt := range tests {
+		auditLog := filepath.Join(dir, fmt.Sprintf("audit-%d.jsonl", i))
+		method := &Method{
+			config:    &aptMethodConfig{auditLog: auditLog},
+			writer:    NewAptMessageWriter(io.Discard),
+			client:    tt.client,
+			dl:        fakeDownloader{},
+			principal: "apt@project.iam.gserviceaccount.com",
+		}
+		method.handleAcquire(context.Background(), &URIAcquire{URI: "ar+https://fake.uri/file", Filename: tt.filename})
+
+		entries := readAuditLog(t, auditLog)
+		if tt.expected == nil {
+			if len(entries) != 0 {
+				t.Errorf("%d failed, expected no entries got: %+v", i, entries)
+			}
+			continue
+		}
+		if len(entries) != 1 {
+			t.Fatalf("%d failed, expected 1 entry got: %+v", i, entries)
+		}
+		got := entries[0]
+		if got.Timestamp == "" {
+			t.Errorf("%d failed, expected a timestamp", i)
+		}
+		expected := *tt.expected
+		expected.Timestamp = got.Timestamp
+		expected.URI = "ar+https://fake.uri/file"
+		expected.Principal = "apt@project.iam.gserviceaccount.com"
+		if got != expected {
+			t.Errorf("%d failed, expected: %+v got: %+v", i, expected, got)
+		}
+	}
+}
+
+func TestHandleAcquireAuditCacheHit(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "cache")
+	src := filepath.Join(dir, "src")
+	writeTestFile(t, src, "package contents")
+	digest := sha256Hex("package contents")
+	if err := newBlobCache(cacheDir, 0).insert(src, digest); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	method := &Method{
+		config:    &aptMethodConfig{cacheDir: cacheDir, auditLog: filepath.Join(dir, "audit.jsonl")},
+		writer:    NewAptMessageWriter(io.Discard),
+		dl:        downloaderImpl{},
+		principal: "apt@project.iam.gserviceaccount.com",
+	}
+	req := &URIAcquire{URI: "ar+https://fake.uri/package.deb", Filename: filepath.Join(dir, "package.deb"), ExpectedSHA256: digest}
+	if err := method.handleAcquire(context.Background(), req); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+
+	entries := readAuditLog(t, method.config.auditLog)
+	if len(entries) != 1 {
+		t.Fatalf("failed, expected 1 entry got: %+v", entries)
+	}
+	expected := auditEntry{Timestamp: entries[0].Timestamp, URI: req.URI, Status: 200, Size: 16, SHA256: digest, CacheHit: true}
+	if entries[0] != expected {
+		t.Errorf("failed, expected: %+v got: %+v", expected, entries[0])
+	}
+}
+
+// panickingDownloader panics part way through a download.
+type panickingDownloader struct{}
+
+func (d panickingDownloader) download(_ io.ReadCloser, _ string) (fileHashes, error) {
+	panic("out of cheese")
+}
+
+func TestHandleAcquirePanic(t *testing.T) {
+	dir := t.TempDir()
+	exporter := &memoryExporter{}
+	tracer, _ := newTracer(exporter, nil)
+	var buffer bytes.Buffer
+	method := &Method{
+		config: &aptMethodConfig{auditLog: filepath.Join(dir, "audit.jsonl"), debugLevel: debugRequests},
+		writer: NewAptMessageWriter(&buffer),
+		client: fakeHTTPClient{},
+		dl:     panickingDownloader{},
+		tracer: tracer,
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != "out of cheese" {
+				t.Errorf("failed, expected the panic to be passed on, got %v", r)
+			}
+		}()
+		method.handleAcquire(context.Background(), &URIAcquire{URI: "ar+https://fake.uri/file", Filename: filepath.Join(dir, "file")})
+	}()
+
+	if entries := readAuditLog(t, method.config.auditLog); len(entries) != 0 {
+		t.Errorf("failed, expected no audit entries got: %+v", entries)
+	}
+	if !strings.Contains(buffer.String(), "msg=\"acquire failed\"") {
+		t.Errorf("failed, expected the acquire to be logged as failed in %q", buffer.String())
+	}
+	if n := method.stats().downloadedBytes; n != 0 {
+		t.Errorf("failed, expected no downloaded bytes counted, got %d", n)
+	}
+	tracer.flush(context.Background())
+	if len(exporter.spans) == 0 || exporter.spans[len(exporter.spans)-1].err == nil {
+		t.Errorf("failed, expected the acquire span to record an error")
+	}
+}
+
+func TestAppendLineConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	const writers, lines = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < lines; i++ {
+				line, _ := json.Marshal(auditEntry{URI: fmt.Sprintf("%d-%d", w, i), SHA256: strings.Repeat("a", 64<<10)})
+				if err := appendLine(path, append(line, '\n')); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if entries := readAuditLog(t, path); len(entries) != writers*lines {
+		t.Errorf("failed, expected: %d entries got: %d", writers*lines, len(entries))
+	}
+}
+
+func TestCredentialsPrincipal(t *testing.T) {
+	token := filepath.Join(t.TempDir(), "token")
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"repo:org/app:ref:refs/heads/main"}`))
+	writeTestFile(t, token, "e30."+claims+".c2ln\n")
+
+	var tests = []struct {
+		json, expected string
+	}{
+		{`{"type":"service_account","client_email":"sa@p.iam.gserviceaccount.com"}`, "sa@p.iam.gserviceaccount.com"},
+		{
+			`{"type":"external_account","audience":"//iam.googleapis.com/pool","service_account_impersonation_url":"https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/ci@p.iam.gserviceaccount.com:generateAccessToken"}`,
+			"ci@p.iam.gserviceaccount.com",
+		},
+		{
+			`{"type":"external_account","audience":"//iam.googleapis.com/pool","credential_source":{"file":"` + token + `"}}`,
+			"repo:org/app:ref:refs/heads/main",
+		},
+		{`{"type":"external_account","audience":"//iam.googleapis.com/pool"}`, "default"},
+		{`{"type":"authorized_user"}`, "default"},
+	}
+	for _, tt := range tests {
+		if got := credentialsPrincipal(&google.Credentials{JSON: []byte(tt.json)}, false); got != tt.expected {
+			t.Errorf("%s failed, expected: %s got: %s", tt.json, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultCacheMaxSize is used when Cache-Dir is set without Cache-Max-Size.
+	defaultCacheMaxSize = 1 << 30
+	// staleTempAge is how old an abandoned temporary file in the cache must be
+	// before eviction removes it.
+	staleTempAge = time.Hour
+)
+
+var sha256Regexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// blobCache is a content-addressed store of downloaded files shared between
+// method processes. Blobs live at <dir>/sha256/<hex digest>. A flock on
+// <dir>/.lock serializes insertion and eviction against lookups.
+type blobCache struct {
+	dir     string
+	maxSize int64
+}
+
+func newBlobCache(dir string, maxSize int64) *blobCache {
+	if maxSize <= 0 {
+		maxSize = defaultCacheMaxSize
+	}
+	return &blobCache{dir: dir, maxSize: maxSize}
+}
+
+func (c *blobCache) blobDir() string {
+	return filepath.Join(c.dir, "sha256")
+}
+
+// lock takes the cache lock, creating the cache directories if needed. The
+// returned file must be passed to unlock.
+func (c *blobCache) lock(exclusive bool) (*os.File, error) {
+	if err := os.MkdirAll(c.blobDir(), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(c.dir, ".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (c *blobCache) unlock(f *os.File) {
+	unlockFile(f)
+	f.Close()
+}
+
+// fetch places the blob with the given SHA256 digest at `dest`, preferring a
+// hardlink and falling back to a copy. It returns false if the blob is not in
+// the cache.
+func (c *blobCache) fetch(digest, dest string) (bool, error) {
+	digest = strings.ToLower(digest)
+	if !sha256Regexp.MatchString(digest) {
+		return false, fmt.Errorf("invalid SHA256 digest %q", digest)
+	}
+	lock, err := c.lock(false)
+	if err != nil {
+		return false, err
+	}
+	defer c.unlock(lock)
+
+	blob := filepath.Join(c.blobDir(), digest)
+	if _, err := os.Stat(blob); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if err := os.Remove(dest); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	if err := os.Link(blob, dest); err != nil {
+		if err := copyFile(blob, dest); err != nil {
+			return false, err
+		}
+	}
+
+	// The modification time records last use for eviction.
+	now := time.Now()
+	os.Chtimes(blob, now, now)
+	return true, nil
+}
+
+// remove drops the blob with the given digest, for example after it was found
+// to be corrupt.
+func (c *blobCache) remove(digest string) error {
+	lock, err := c.lock(true)
+	if err != nil {
+		return err
+	}
+	defer c.unlock(lock)
+	return os.Remove(filepath.Join(c.blobDir(), strings.ToLower(digest)))
+}
+
+// insert copies the file at `src`, whose SHA256 digest is `digest`, into the
+// cache and then evicts the least recently used blobs until the cache fits
+// within its maximum size.
+func (c *blobCache) insert(src, digest string) error {
+	digest = strings.ToLower(digest)
+	if !sha256Regexp.MatchString(digest) {
+		return fmt.Errorf("invalid SHA256 digest %q", digest)
+	}
+	lock, err := c.lock(true)
+	if err != nil {
+		return err
+	}
+	defer c.unlock(lock)
+
+	blob := filepath.Join(c.blobDir(), digest)
+	if _, err := os.Stat(blob); err == nil {
+		return nil
+	}
+
+	// Copy to a temporary file and rename it into place so that other
+	// processes never see a partial blob.
+	tmp, err := os.CreateTemp(c.blobDir(), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	in, err := os.Open(src)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	_, err = io.Copy(tmp, in)
+	in.Close()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), blob); err != nil {
+		return err
+	}
+	return c.evict()
+}
+
+// evict removes the least recently used blobs until the total size is within
+// maxSize. It must be called with the exclusive lock held.
+func (c *blobCache) evict() error {
+	entries, err := os.ReadDir(c.blobDir())
+	if err != nil {
+		return err
+	}
+	var blobs []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			if time.Since(info.ModTime()) > staleTempAge {
+				os.Remove(filepath.Join(c.blobDir(), entry.Name()))
+			}
+			continue
+		}
+		blobs = append(blobs, info)
+		total += info.Size()
+	}
+	if total <= c.maxSize {
+		return nil
+	}
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].ModTime().Before(blobs[j].ModTime())
+	})
+	for _, blob := range blobs {
+		if total <= c.maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.blobDir(), blob.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		total -= blob.Size()
+	}
+	return nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
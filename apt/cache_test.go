@@ -0,0 +1,170 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sha256Hex(data string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+}
+
+func writeTestFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestBlobCacheInsertFetch(t *testing.T) {
+	dir := t.TempDir()
+	cache := newBlobCache(filepath.Join(dir, "cache"), 0)
+	src := filepath.Join(dir, "src")
+	writeTestFile(t, src, "package contents")
+	digest := sha256Hex("package contents")
+
+	dest := filepath.Join(dir, "dest")
+	if hit, err := cache.fetch(digest, dest); err != nil || hit {
+		t.Fatalf("failed, expected miss on empty cache, got hit=%v err=%v", hit, err)
+	}
+	if err := cache.insert(src, digest); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	// An existing destination file is replaced.
+	writeTestFile(t, dest, "stale")
+	if hit, err := cache.fetch(strings.ToUpper(digest), dest); err != nil || !hit {
+		t.Fatalf("failed, expected hit, got hit=%v err=%v", hit, err)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "package contents" {
+		t.Errorf("failed, expected cached contents, got %q", data)
+	}
+	if _, err := cache.fetch("not-a-digest", dest); err == nil {
+		t.Errorf("failed, expected error for invalid digest")
+	}
+}
+
+func TestBlobCacheEvict(t *testing.T) {
+	dir := t.TempDir()
+	cache := newBlobCache(filepath.Join(dir, "cache"), 12)
+
+	var digests []string
+	for i, data := range []string{"aaaa", "bbbb", "cccc"} {
+		src := filepath.Join(dir, data)
+		writeTestFile(t, src, data)
+		digest := sha256Hex(data)
+		digests = append(digests, digest)
+		if err := cache.insert(src, digest); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+		// Make use order deterministic regardless of timestamp granularity.
+		when := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(filepath.Join(cache.blobDir(), digest), when, when)
+	}
+	// Using the oldest blob makes the second one least recently used.
+	if hit, err := cache.fetch(digests[0], filepath.Join(dir, "dest")); err != nil || !hit {
+		t.Fatalf("failed, expected hit, got hit=%v err=%v", hit, err)
+	}
+
+	src := filepath.Join(dir, "dddd")
+	writeTestFile(t, src, "dddd")
+	if err := cache.insert(src, sha256Hex("dddd")); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	for digest, expected := range map[string]bool{
+		digests[0]:        true,
+		digests[1]:        false,
+		digests[2]:        true,
+		sha256Hex("dddd"): true,
+	} {
+		_, err := os.Stat(filepath.Join(cache.blobDir(), digest))
+		if exists := err == nil; exists != expected {
+			t.Errorf("failed, blob %s exists=%v, expected %v", digest, exists, expected)
+		}
+	}
+}
+
+func TestHandleAcquireCacheHit(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "cache")
+	src := filepath.Join(dir, "src")
+	writeTestFile(t, src, "package contents")
+	digest := sha256Hex("package contents")
+	if err := newBlobCache(cacheDir, 0).insert(src, digest); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	var requests []*http.Request
+	var buffer bytes.Buffer
+	method := &Method{
+		config: &aptMethodConfig{cacheDir: cacheDir},
+		writer: NewAptMessageWriter(&buffer),
+		client: fakeHTTPClient{requests: &requests},
+		dl:     downloaderImpl{},
+	}
+	filename := filepath.Join(dir, "package.deb")
+	req := &URIAcquire{
+		URI:            "ar+https://fake.uri/package.deb",
+		Filename:       filename,
+		ExpectedSHA256: digest,
+	}
+	if err := method.handleAcquire(context.Background(), req); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if !strings.Contains(buffer.String(), "201 URI Done") {
+		t.Errorf("failed, didn't receive uri done message in %q", buffer.String())
+	}
+	if data, _ := os.ReadFile(filename); string(data) != "package contents" {
+		t.Errorf("failed, expected cached contents, got %q", data)
+	}
+	if len(requests) != 0 {
+		t.Errorf("failed, expected no requests got: %v", requestedHosts(requests))
+	}
+}
+
+func TestHandleAcquireCachePopulate(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "cache")
+	digest := sha256Hex("package contents")
+
+	var buffer bytes.Buffer
+	method := &Method{
+		config: &aptMethodConfig{cacheDir: cacheDir},
+		writer: NewAptMessageWriter(&buffer),
+		client: fakeHTTPClient{body: "package contents"},
+		dl:     downloaderImpl{},
+	}
+	req := &URIAcquire{
+		URI:            "ar+https://fake.uri/package.deb",
+		Filename:       filepath.Join(dir, "package.deb"),
+		ExpectedSHA256: digest,
+	}
+	if err := method.handleAcquire(context.Background(), req); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(cacheDir, "sha256", digest)); err != nil || string(data) != "package contents" {
+		t.Errorf("failed, expected download in cache, got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,467 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// configPrefix is the prefix of the method's own configuration keys.
+	configPrefix = "Acquire::gar::"
+	// debugConfigKey enables debug logging.
+	debugConfigKey = "Debug::Acquire::gar"
+	// maxRetries bounds Retries. With the doubling delays, capped at
+	// maxRetryDelay, the waits before the retries add up to about three minutes.
+	maxRetries = 10
+)
+
+// configOption describes a configuration key the method understands. `apply`
+// parses the value and stores it in the config, or returns an error
+// describing why it is invalid.
+type configOption struct {
+	key   string
+	apply func(c *aptMethodConfig, value string) error
+}
+
+// configSchema lists every configuration key the method understands, apart
+// from the Mirrors lists and host overrides. The hostOptions are added by
+// init.
+var configSchema = []configOption{
+	pathOption(configPrefix+"Service-Account-JSON", func(c *aptMethodConfig, v string) { c.serviceAccountJSON = v }),
+	stringOption(configPrefix+"Service-Account-Email", func(c *aptMethodConfig, v string) { c.serviceAccountEmail = v }),
+	boolOption(configPrefix+"Redirect-Foreign-Hosts", func(c *aptMethodConfig, v bool) { c.redirectForeignHosts = v }),
+	pathOption(configPrefix+"State-Dir", func(c *aptMethodConfig, v string) { c.stateDir = v }),
+	pathOption(configPrefix+"Cache-Dir", func(c *aptMethodConfig, v string) { c.cacheDir = v }),
+	sizeOption(configPrefix+"Cache-Max-Size", func(c *aptMethodConfig, v int64) { c.cacheMaxSize = v }),
+	boolOption("Acquire::ForceIPv4", func(c *aptMethodConfig, v bool) { c.forceIPv4 = v }),
+	boolOption("Acquire::ForceIPv6", func(c *aptMethodConfig, v bool) { c.forceIPv6 = v }),
+	levelOption(debugConfigKey, func(c *aptMethodConfig, v int) { c.debugLevel = v }),
+	pathOption(configPrefix+"Log-File", func(c *aptMethodConfig, v string) { c.logFile = v }),
+	logFormatOption(configPrefix+"Log-Format", func(c *aptMethodConfig, v string) { c.logFormat = v }),
+	pathOption(configPrefix+"Metrics-File", func(c *aptMethodConfig, v string) { c.metricsFile = v }),
+	endpointOption(configPrefix+"Trace-Endpoint", func(c *aptMethodConfig, v string) { c.traceEndpoint = v }),
+	pathOption(configPrefix+"Audit-Log", func(c *aptMethodConfig, v string) { c.auditLog = v }),
+}
+
+// hostOptions may be set for every host as Acquire::gar::<Key>, and
+// overridden for one host as Acquire::gar::<host>::<Key>, following apt's
+// Acquire::https::<host> convention. Debug is set globally by
+// Debug::Acquire::gar.
+var hostOptions = []configOption{
+	durationOption("Timeout", func(c *aptMethodConfig, v time.Duration) { c.timeout = v }),
+	intOption("Retries", maxRetries, func(c *aptMethodConfig, v int) { c.retries = v }),
+	proxyOption("Proxy", func(c *aptMethodConfig, v string) { c.proxy = v }),
+	pathOption("CaInfo", func(c *aptMethodConfig, v string) { c.caInfo = v }),
+	levelOption("Debug", func(c *aptMethodConfig, v int) { c.debugLevel = v }),
+}
+
+func init() {
+	for _, opt := range hostOptions {
+		if opt.key != "Debug" {
+			configSchema = append(configSchema, configOption{configPrefix + opt.key, opt.apply})
+		}
+	}
+}
+
+func stringOption(key string, set func(*aptMethodConfig, string)) configOption {
+	return configOption{key, func(c *aptMethodConfig, value string) error {
+		set(c, value)
+		return nil
+	}}
+}
+
+// boolOption accepts the values apt itself treats as booleans.
+func boolOption(key string, set func(*aptMethodConfig, bool)) configOption {
+	return configOption{key, func(c *aptMethodConfig, value string) error {
+		b, err := parseBool(value)
+		if err != nil {
+			return err
+		}
+		set(c, b)
+		return nil
+	}}
+}
+
+// intOption accepts an integer from 0 to `max`.
+func intOption(key string, max int, set func(*aptMethodConfig, int)) configOption {
+	return configOption{key, func(c *aptMethodConfig, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > max {
+			return fmt.Errorf("invalid count %q, expected 0 to %d", value, max)
+		}
+		set(c, n)
+		return nil
+	}}
+}
+
+// levelOption accepts a debug level from 0 to debugWire, or a boolean for
+// level 0 or 1, as when debugging was either on or off.
+func levelOption(key string, set func(*aptMethodConfig, int)) configOption {
+	return configOption{key, func(c *aptMethodConfig, value string) error {
+		if n, err := strconv.Atoi(value); err == nil {
+			if n < 0 || n > debugWire {
+				return fmt.Errorf("invalid debug level %q, must be 0 to %d", value, debugWire)
+			}
+			set(c, n)
+			return nil
+		}
+		b, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid debug level %q", value)
+		}
+		if b {
+			set(c, debugRequests)
+		} else {
+			set(c, 0)
+		}
+		return nil
+	}}
+}
+
+// logFormatOption accepts "json" or "text".
+func logFormatOption(key string, set func(*aptMethodConfig, string)) configOption {
+	return configOption{key, func(c *aptMethodConfig, value string) error {
+		switch format := strings.ToLower(value); format {
+		case logFormatJSON, logFormatText:
+			set(c, format)
+			return nil
+		}
+		return fmt.Errorf("invalid log format %q, must be json or text", value)
+	}}
+}
+
+// proxyOption accepts a proxy URL, or "DIRECT" to connect without one as in
+// apt.
+func proxyOption(key string, set func(*aptMethodConfig, string)) configOption {
+	return configOption{key, func(c *aptMethodConfig, value string) error {
+		if value != "DIRECT" {
+			u, err := url.Parse(value)
+			if err != nil || u.Host == "" {
+				return fmt.Errorf("invalid proxy %q", value)
+			}
+			switch u.Scheme {
+			case "http", "https", "socks5":
+			default:
+				return fmt.Errorf("invalid proxy %q, unsupported scheme", value)
+			}
+		}
+		set(c, value)
+		return nil
+	}}
+}
+
+// endpointOption accepts an http or https URL.
+func endpointOption(key string, set func(*aptMethodConfig, string)) configOption {
+	return configOption{key, func(c *aptMethodConfig, value string) error {
+		u, err := url.Parse(value)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid endpoint %q", value)
+		}
+		set(c, value)
+		return nil
+	}}
+}
+
+// durationOption accepts a Go duration such as "90s", or a number of seconds
+// as apt uses for its own timeouts.
+func durationOption(key string, set func(*aptMethodConfig, time.Duration)) configOption {
+	return configOption{key, func(c *aptMethodConfig, value string) error {
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			set(c, time.Duration(n)*time.Second)
+			return nil
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		set(c, d)
+		return nil
+	}}
+}
+
+// pathOption requires an absolute path, since the method's working directory
+// is unrelated to the apt configuration.
+func pathOption(key string, set func(*aptMethodConfig, string)) configOption {
+	return configOption{key, func(c *aptMethodConfig, value string) error {
+		if !filepath.IsAbs(value) {
+			return fmt.Errorf("%q is not an absolute path", value)
+		}
+		set(c, filepath.Clean(value))
+		return nil
+	}}
+}
+
+func sizeOption(key string, set func(*aptMethodConfig, int64)) configOption {
+	return configOption{key, func(c *aptMethodConfig, value string) error {
+		n, err := parseSize(value)
+		if err != nil {
+			return err
+		}
+		set(c, n)
+		return nil
+	}}
+}
+
+// parseBool is stringToBool, but rejects values which are neither true nor
+// false to apt.
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "1", "yes", "true", "with", "on", "enable":
+		return true, nil
+	case "0", "no", "false", "without", "off", "disable":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q", s)
+}
+
+// lookupOption returns the entry for `key` in `schema`. Like apt, keys are
+// case insensitive.
+func lookupOption(schema []configOption, key string) (configOption, bool) {
+	for _, opt := range schema {
+		if strings.EqualFold(opt.key, key) {
+			return opt, true
+		}
+	}
+	return configOption{}, false
+}
+
+// splitHostKey splits a host override key, Acquire::gar::<host>::<Key>, into
+// the lower-cased host and the rest of the key.
+func splitHostKey(key string) (string, string, bool) {
+	if !hasPrefixFold(key, configPrefix) {
+		return "", "", false
+	}
+	host, rest, ok := strings.Cut(key[len(configPrefix):], "::")
+	if !ok || host == "" || strings.EqualFold(host, "Mirrors") {
+		return "", "", false
+	}
+	return strings.ToLower(host), rest, true
+}
+
+// hasPrefixFold is strings.HasPrefix, ignoring case.
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// isMethodKey reports whether `key` is in the method's own namespace, where an
+// unknown key is most likely a mistake.
+func isMethodKey(key string) bool {
+	return hasPrefixFold(key, configPrefix) || hasPrefixFold(key, debugConfigKey)
+}
+
+// suggestKey returns the key in `schema` closest to `key`, if it is close
+// enough to be a likely typo.
+func suggestKey(schema []configOption, key string) (string, bool) {
+	best, bestDistance := "", 4
+	for _, opt := range schema {
+		if d := levenshtein(strings.ToLower(key), strings.ToLower(opt.key)); d < bestDistance {
+			best, bestDistance = opt.key, d
+		}
+	}
+	return best, best != ""
+}
+
+// levenshtein returns the edit distance between `a` and `b`.
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// dequoteConfig reverses the %XX encoding apt applies to configuration keys
+// and values. A value which isn't validly encoded is returned as-is.
+func dequoteConfig(s string) string {
+	if unquoted, err := url.PathUnescape(s); err == nil {
+		return unquoted
+	}
+	return s
+}
+
+// configItem is a configuration key and value, and where it was set.
+type configItem struct {
+	key, value string
+	source     string
+}
+
+// aptConfigSource is the source of items from 601 Configuration messages.
+const aptConfigSource = "apt"
+
+// parseConfigItems splits the items of a 601 Configuration message into keys
+// and values. It returns an error for each malformed item, which is skipped.
+func parseConfigItems(items []string) ([]configItem, []error) {
+	var parsed []configItem
+	var errs []error
+	for _, item := range items {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok || key == "" {
+			errs = append(errs, fmt.Errorf("malformed config item: %v", item))
+			continue
+		}
+		parsed = append(parsed, configItem{dequoteConfig(key), dequoteConfig(value), aptConfigSource})
+	}
+	return parsed, errs
+}
+
+// mergeConfigItems returns `items` updated with `update`. The values given for
+// a key in `update` replace all of those previously held for it, so a list,
+// which apt sends as a repeated "Key::" item, is replaced as a whole.
+func mergeConfigItems(items, update []configItem) []configItem {
+	updated := make(map[string]bool)
+	for _, item := range update {
+		updated[strings.ToLower(item.key)] = true
+	}
+	var merged []configItem
+	for _, item := range items {
+		if !updated[strings.ToLower(item.key)] {
+			merged = append(merged, item)
+		}
+	}
+	return append(merged, update...)
+}
+
+// describeConfig lists the method's own items among `items`, with their
+// sources, for debugging.
+func describeConfig(items []configItem) string {
+	var b strings.Builder
+	b.WriteString("effective configuration:")
+	for _, item := range items {
+		if isMethodKey(item.key) || hasPrefixFold(item.key, "Acquire::Force") {
+			fmt.Fprintf(&b, "\n%s=%s (from %s)", item.key, item.value, item.source)
+		}
+	}
+	return b.String()
+}
+
+// buildConfig returns the method configuration described by `items`, along
+// with an error for each item which is invalid or unknown. Invalid items
+// leave the setting at its default.
+func buildConfig(items []configItem) (*aptMethodConfig, []error) {
+	config := &aptMethodConfig{}
+	var errs []error
+	for _, item := range items {
+		key, value := item.key, strings.TrimSpace(item.value)
+		if hasPrefixFold(key, mirrorsConfigPrefix) {
+			config.addMirror(key[len(mirrorsConfigPrefix):], value)
+			continue
+		}
+		if opt, ok := lookupOption(configSchema, key); ok {
+			if err := opt.apply(config, value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid config item %s: %v", key, err))
+			}
+			continue
+		}
+		if value == "" {
+			// A node apt sends for each level of the configuration tree.
+			continue
+		}
+		if host, name, ok := splitHostKey(key); ok {
+			if err := config.addHostItem(host, name, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", key, err))
+			}
+			continue
+		}
+		if !isMethodKey(key) {
+			// Another component's setting.
+			continue
+		}
+		errs = append(errs, unknownKeyError(configSchema, key))
+	}
+	// Enforce the precedence of these two options.
+	if config.serviceAccountJSON != "" {
+		config.serviceAccountEmail = ""
+	}
+	return config, errs
+}
+
+// unknownKeyError reports an unknown `key`, suggesting the nearest one in
+// `schema`.
+func unknownKeyError(schema []configOption, key string) error {
+	if suggestion, ok := suggestKey(schema, key); ok {
+		return fmt.Errorf("unknown config item %s, did you mean %s?", key, suggestion)
+	}
+	return fmt.Errorf("unknown config item %s", key)
+}
+
+// addHostItem records the override of `name` for `host`, after checking it is
+// valid. Mirrors for a host are added to the mirrors of the whole host.
+func (c *aptMethodConfig) addHostItem(host, name, value string) error {
+	if hasPrefixFold(name, "Mirrors::") {
+		c.addMirror(host+"::", value)
+		return nil
+	}
+	opt, ok := lookupOption(hostOptions, name)
+	if !ok {
+		return unknownKeyError(hostOptions, name)
+	}
+	if err := opt.apply(&aptMethodConfig{}, value); err != nil {
+		return err
+	}
+	if c.hosts == nil {
+		c.hosts = make(map[string][]field)
+	}
+	c.hosts[host] = append(c.hosts[host], field{opt.key, value})
+	return nil
+}
+
+// forHost returns the effective configuration for requests to `host`, which
+// is `c` with any overrides for the host applied.
+func (c *aptMethodConfig) forHost(host string) *aptMethodConfig {
+	items := c.hosts[strings.ToLower(host)]
+	if len(items) == 0 {
+		return c
+	}
+	effective := *c
+	for _, item := range items {
+		opt, _ := lookupOption(hostOptions, item.key)
+		opt.apply(&effective, item.value)
+	}
+	return &effective
+}
+
+// sameClient reports whether clients built for `c` are also right for
+// `other`, having the same credentials and transport settings, globally and
+// for each host.
+func (c *aptMethodConfig) sameClient(other *aptMethodConfig) bool {
+	return c.serviceAccountJSON == other.serviceAccountJSON &&
+		c.serviceAccountEmail == other.serviceAccountEmail &&
+		c.timeout == other.timeout &&
+		c.proxy == other.proxy &&
+		c.caInfo == other.caInfo &&
+		c.forceIPv4 == other.forceIPv4 &&
+		c.forceIPv6 == other.forceIPv6 &&
+		maps.EqualFunc(c.hosts, other.hosts, slices.Equal)
+}
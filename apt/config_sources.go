@@ -0,0 +1,124 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// defaultConfigFile is read, if it exists, for configuration which
+	// applies even when the method isn't run by apt.
+	defaultConfigFile = "/etc/artifact-registry-apt/config"
+	// configFileEnv names a config file to read instead of the default.
+	configFileEnv = "AR_APT_CONFIG"
+	// envPrefix is the prefix of environment variables setting options, as
+	// AR_APT_<OPTION>, for example AR_APT_SERVICE_ACCOUNT_JSON.
+	envPrefix = "AR_APT_"
+)
+
+// loadConfigSources returns the configuration items from the config file and
+// from `environ`, the environment, in which the latter take precedence. It
+// also returns any problems found, none of which prevent the other items
+// from being used. Setting AR_APT_CONFIG to "" skips the config file.
+func loadConfigSources(environ []string) ([]configItem, []error) {
+	path, explicit := defaultConfigFile, false
+	for _, kv := range environ {
+		if name, value, _ := strings.Cut(kv, "="); name == configFileEnv {
+			path, explicit = value, true
+		}
+	}
+
+	var fileItems []configItem
+	var errs []error
+	if path != "" {
+		// The default file is optional.
+		if _, err := os.Stat(path); explicit || !errors.Is(err, os.ErrNotExist) {
+			fileItems, errs = loadConfigFile(path)
+		}
+	}
+	envItems, envErrs := envConfigItems(environ)
+	return mergeConfigItems(fileItems, envItems), append(errs, envErrs...)
+}
+
+// loadConfigFile reads a config file of "Key=Value" lines, with keys as in
+// apt's configuration, such as "Acquire::gar::Service-Account-JSON". Blank
+// lines and lines starting with "#" are ignored.
+func loadConfigFile(path string) ([]configItem, []error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, []error{fmt.Errorf("failed to read config file: %w", err)}
+	}
+	defer f.Close()
+
+	var items []configItem
+	var errs []error
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", path, lineno)
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			errs = append(errs, fmt.Errorf("%s: malformed config item: %v", source, line))
+			continue
+		}
+		items = append(items, configItem{key, strings.TrimSpace(value), source})
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to read config file: %w", err))
+	}
+	return items, errs
+}
+
+// envConfigKeys maps each option's environment variable to its key.
+func envConfigKeys() map[string]string {
+	keys := map[string]string{envPrefix + "DEBUG": debugConfigKey}
+	for _, opt := range configSchema {
+		if hasPrefixFold(opt.key, configPrefix) {
+			name := strings.ReplaceAll(opt.key[len(configPrefix):], "-", "_")
+			keys[envPrefix+strings.ToUpper(name)] = opt.key
+		}
+	}
+	return keys
+}
+
+// envConfigItems returns the configuration items set by AR_APT_* variables
+// in `environ`, and an error for each unknown variable.
+func envConfigItems(environ []string) ([]configItem, []error) {
+	keys := envConfigKeys()
+	var items []configItem
+	var errs []error
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, envPrefix) || name == configFileEnv {
+			continue
+		}
+		key, ok := keys[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown environment variable %s", name))
+			continue
+		}
+		items = append(items, configItem{key, value, "environment " + name})
+	}
+	return items, errs
+}
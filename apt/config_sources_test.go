@@ -0,0 +1,140 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigSources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	writeTestFile(t, path, `# Shared settings.
+Acquire::gar::Service-Account-Email = file@domain
+Acquire::gar::Timeout=10
+
+not a config item
+Acquire::gar::Retries=3
+`)
+
+	items, errs := loadConfigSources([]string{
+		"HOME=/root",
+		"AR_APT_CONFIG=" + path,
+		"AR_APT_TIMEOUT=30",
+		"AR_APT_DEBUG=1",
+		"AR_APT_BOGUS=1",
+	})
+	expected := []configItem{
+		{"Acquire::gar::Service-Account-Email", "file@domain", path + ":2"},
+		{"Acquire::gar::Retries", "3", path + ":6"},
+		{"Acquire::gar::Timeout", "30", "environment AR_APT_TIMEOUT"},
+		{"Debug::Acquire::gar", "1", "environment AR_APT_DEBUG"},
+	}
+	if !reflect.DeepEqual(items, expected) {
+		t.Errorf("failed, expected: %+v got: %+v", expected, items)
+	}
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	expectedErrs := []string{
+		path + ":5: malformed config item: not a config item",
+		"unknown environment variable AR_APT_BOGUS",
+	}
+	if !reflect.DeepEqual(messages, expectedErrs) {
+		t.Errorf("failed, expected: %q got: %q", expectedErrs, messages)
+	}
+
+	// A missing file is only a problem if it was named explicitly.
+	missing := filepath.Join(t.TempDir(), "missing")
+	if _, errs := loadConfigSources([]string{"AR_APT_CONFIG=" + missing}); len(errs) != 1 {
+		t.Errorf("failed, expected an error for missing config file, got %v", errs)
+	}
+	if _, errs := loadConfigSources([]string{"AR_APT_CONFIG="}); len(errs) != 0 {
+		t.Errorf("failed, expected no errors with config file disabled, got %v", errs)
+	}
+}
+
+func TestHandleConfigureSources(t *testing.T) {
+	var buffer bytes.Buffer
+	method := &Method{config: &aptMethodConfig{}, writer: NewAptMessageWriter(&buffer)}
+	method.baseItems = []configItem{
+		{"Acquire::gar::Service-Account-Email", "file@domain", "/etc/artifact-registry-apt/config:1"},
+		{"Acquire::gar::Timeout", "30", "environment AR_APT_TIMEOUT"},
+		{"Debug::Acquire::gar", "true", "environment AR_APT_DEBUG"},
+	}
+	method.handleConfigure(&Configuration{ConfigItems: []string{
+		"Acquire::gar::Service-Account-Email=apt@domain",
+		"APT::Architecture=amd64",
+	}})
+
+	if method.config.serviceAccountEmail != "apt@domain" || method.config.timeout != 30*time.Second || method.config.debugLevel != 1 {
+		t.Errorf("failed, apt should override the other sources, got %+v", method.config)
+	}
+	for _, expected := range []string{
+		"Acquire::gar::Timeout=30 (from environment AR_APT_TIMEOUT)",
+		"Acquire::gar::Service-Account-Email=apt@domain (from apt)",
+	} {
+		if !strings.Contains(buffer.String(), expected) {
+			t.Errorf("failed, expected %q to be logged in %q", expected, buffer.String())
+		}
+	}
+	if strings.Contains(buffer.String(), "APT::Architecture") {
+		t.Errorf("failed, unrelated config was logged in %q", buffer.String())
+	}
+}
+
+func TestStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	writeTestFile(t, path, "Acquire::gar::Timout=10\n")
+	var buffer bytes.Buffer
+	method := &Method{writer: NewAptMessageWriter(&buffer)}
+	method.loadBaseConfig([]string{
+		"AR_APT_CONFIG=" + path,
+		"AR_APT_TIMEOUT=abc",
+		"AR_APT_RETRIES=2",
+		"AR_APT_DEBUG=1",
+		"AR_APT_BOGUS=1",
+	})
+	method.start(method.writer)
+
+	expected := []string{
+		"unknown environment variable AR_APT_BOGUS",
+		"unknown config item Acquire::gar::Timout, did you mean Acquire::gar::Timeout?",
+		`invalid config item Acquire::gar::Timeout: invalid duration "abc"`,
+		"Acquire::gar::Retries=2 (from environment AR_APT_RETRIES)",
+	}
+	for _, e := range expected {
+		if !strings.Contains(buffer.String(), e) {
+			t.Errorf("failed, expected %q to be logged in %q", e, buffer.String())
+		}
+	}
+
+	// The problems aren't reported again when apt's configuration arrives.
+	buffer.Reset()
+	method.handleConfigure(&Configuration{ConfigItems: []string{"Acquire::gar::Retries=many"}})
+	for _, e := range expected[:3] {
+		if strings.Contains(buffer.String(), e) {
+			t.Errorf("failed, %q was reported twice in %q", e, buffer.String())
+		}
+	}
+	if !strings.Contains(buffer.String(), `invalid count "many"`) {
+		t.Errorf("failed, expected apt's invalid item to be reported in %q", buffer.String())
+	}
+}
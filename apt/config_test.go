@@ -0,0 +1,203 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleConfigureValidation(t *testing.T) {
+	var buffer bytes.Buffer
+	method := &Method{config: &aptMethodConfig{}, writer: NewAptMessageWriter(&buffer)}
+	method.handleConfigure(&Configuration{ConfigItems: []string{
+		"no-equals-sign",
+		"Acquire::gar::Service-Acount-JSON=/path/to/creds.json",
+		"Acquire::gar::Something-Else=1",
+		"Acquire::gar::Redirect-Foreign-Hosts=maybe",
+		"Acquire::gar::Cache-Dir=relative/dir",
+		"Acquire::gar::Cache-Max-Size=lots",
+		"Acquire::gar::Timeout=soon",
+		"Acquire::gar::Retries=100",
+		"Debug::Acquire::garr=1",
+		// Valid items after the problems are still applied.
+		"Acquire::gar::Service-Account-Email=email@domain",
+		"acquire::gar::timeout=90",
+		"Acquire::gar::State-Dir=/var/lib/gar%20state",
+		"Acquire::gar=",
+		"Acquire::http::Proxy=http://proxy",
+	}})
+
+	for _, expected := range []string{
+		"malformed config item: no-equals-sign",
+		"unknown config item Acquire::gar::Service-Acount-JSON, did you mean Acquire::gar::Service-Account-JSON?",
+		"unknown config item Acquire::gar::Something-Else\n",
+		`invalid config item Acquire::gar::Redirect-Foreign-Hosts: invalid boolean "maybe"`,
+		`invalid config item Acquire::gar::Cache-Dir: "relative/dir" is not an absolute path`,
+		`invalid config item Acquire::gar::Cache-Max-Size: invalid size "lots"`,
+		`invalid config item Acquire::gar::Timeout: invalid duration "soon"`,
+		`invalid config item Acquire::gar::Retries: invalid count "100", expected 0 to 10`,
+		"unknown config item Debug::Acquire::garr, did you mean Debug::Acquire::gar?",
+	} {
+		if !strings.Contains(buffer.String(), expected) {
+			t.Errorf("failed, expected %q to be logged in %q", expected, buffer.String())
+		}
+	}
+	if logged := strings.Count(buffer.String(), "101 Log"); logged != 9 {
+		t.Errorf("failed, expected 9 problems to be logged, got %d", logged)
+	}
+
+	expected := aptMethodConfig{
+		serviceAccountEmail: "email@domain",
+		timeout:             90 * time.Second,
+		stateDir:            "/var/lib/gar state",
+	}
+	if !reflect.DeepEqual(*method.config, expected) {
+		t.Errorf("failed, expected: %+v got: %+v", expected, *method.config)
+	}
+}
+
+func TestParseBool(t *testing.T) {
+	for _, s := range []string{"1", "yes", "True", "on", "enable", "with"} {
+		if b, err := parseBool(s); err != nil || !b {
+			t.Errorf("parseBool(%q) = %v, %v, expected true", s, b, err)
+		}
+	}
+	for _, s := range []string{"0", "no", "False", "off", "disable", "without"} {
+		if b, err := parseBool(s); err != nil || b {
+			t.Errorf("parseBool(%q) = %v, %v, expected false", s, b, err)
+		}
+	}
+	for _, s := range []string{"", "10", "-1", "maybe"} {
+		if _, err := parseBool(s); err == nil {
+			t.Errorf("parseBool(%q) succeeded, expected an error", s)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	var tests = []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"kitten", "sitting", 3},
+		{"Service-Acount-JSON", "Service-Account-JSON", 1},
+	}
+
+	for _, tt := range tests {
+		if res := levenshtein(tt.a, tt.b); res != tt.expected {
+			t.Errorf("levenshtein(%q, %q) = %d, expected %d", tt.a, tt.b, res, tt.expected)
+		}
+	}
+}
+
+func TestHostOverrides(t *testing.T) {
+	var buffer bytes.Buffer
+	method := &Method{config: &aptMethodConfig{}, writer: NewAptMessageWriter(&buffer)}
+	method.handleConfigure(&Configuration{ConfigItems: []string{
+		"Acquire::gar::Timeout=10",
+		"Acquire::gar::Retries=1",
+		"Acquire::gar::us-apt.pkg.dev=",
+		"Acquire::gar::us-apt.pkg.dev::Timeout=60",
+		"Acquire::gar::US-APT.pkg.dev::Proxy=http://proxy:3128",
+		"Acquire::gar::us-apt.pkg.dev::Debug=true",
+		"Acquire::gar::us-apt.pkg.dev::Mirrors::=europe-apt.pkg.dev",
+		"Acquire::gar::other.pkg.dev::Timout=5",
+		"Acquire::gar::other.pkg.dev::Retries=many",
+	}})
+
+	for _, expected := range []string{
+		"unknown config item Timout, did you mean Timeout?",
+		`Acquire::gar::other.pkg.dev::Retries: invalid count "many"`,
+	} {
+		if !strings.Contains(buffer.String(), expected) {
+			t.Errorf("failed, expected %q to be logged in %q", expected, buffer.String())
+		}
+	}
+	if _, ok := method.config.hosts["other.pkg.dev"]; ok {
+		t.Errorf("failed, invalid overrides were kept: %v", method.config.hosts)
+	}
+
+	var tests = []struct {
+		host     string
+		timeout  time.Duration
+		retries  int
+		proxy    string
+		debug    int
+		override bool
+	}{
+		{"us-apt.pkg.dev", 60 * time.Second, 1, "http://proxy:3128", 1, true},
+		{"US-APT.PKG.DEV", 60 * time.Second, 1, "http://proxy:3128", 1, true},
+		{"europe-apt.pkg.dev", 10 * time.Second, 1, "", 0, false},
+	}
+	for _, tt := range tests {
+		config := method.config.forHost(tt.host)
+		if config.timeout != tt.timeout || config.retries != tt.retries || config.proxy != tt.proxy || config.debugLevel != tt.debug {
+			t.Errorf("forHost(%q) failed, got %+v", tt.host, config)
+		}
+		if override := config != method.config; override != tt.override {
+			t.Errorf("forHost(%q) failed, override %v expected %v", tt.host, override, tt.override)
+		}
+	}
+	if mirrors := method.config.mirrors["us-apt.pkg.dev"]; !reflect.DeepEqual(mirrors, []string{"europe-apt.pkg.dev"}) {
+		t.Errorf("failed, expected host mirror, got %v", method.config.mirrors)
+	}
+}
+
+// recordingClientFactory returns a fake client, recording the config each is
+// built for.
+type recordingClientFactory struct {
+	configs []*aptMethodConfig
+}
+
+func (f *recordingClientFactory) newClient(_ context.Context, config *aptMethodConfig) (httpClient, error) {
+	f.configs = append(f.configs, config)
+	return fakeHTTPClient{}, nil
+}
+
+func TestInitClientPerHost(t *testing.T) {
+	factory := &recordingClientFactory{}
+	method := &Method{config: &aptMethodConfig{}, writer: NewAptMessageWriter(io.Discard), newClient: factory.newClient}
+	method.handleConfigure(&Configuration{ConfigItems: []string{
+		"Acquire::gar::Timeout=10",
+		"Acquire::gar::slow.pkg.dev::Timeout=60",
+	}})
+
+	ctx := context.Background()
+	for _, host := range []string{"us-apt.pkg.dev", "slow.pkg.dev", "europe-apt.pkg.dev", "SLOW.pkg.dev"} {
+		if _, err := method.initClient(ctx, host); err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+	}
+	if len(factory.configs) != 2 || factory.configs[0].timeout != 10*time.Second || factory.configs[1].timeout != 60*time.Second {
+		t.Errorf("failed, expected a global and a host client, got %+v", factory.configs)
+	}
+
+	// Changing an override rebuilds the clients.
+	method.handleConfigure(&Configuration{ConfigItems: []string{"Acquire::gar::slow.pkg.dev::Timeout=90"}})
+	if _, err := method.initClient(ctx, "slow.pkg.dev"); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if len(factory.configs) != 3 || factory.configs[2].timeout != 90*time.Second {
+		t.Errorf("failed, expected the host client to be rebuilt, got %+v", factory.configs)
+	}
+}
@@ -0,0 +1,28 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// Package apt implements the apt method protocol, and the Artifact Registry
+// method built on it.
+//
+// Other methods can be written by implementing Handler and running it with a
+// Server:
+//
+//	server := apt.NewServer(handler, bufio.NewReader(os.Stdin), os.Stdout, apt.WithSendConfig(true))
+//	if err := server.Serve(ctx); err != nil {
+//		os.Exit(100)
+//	}
+//
+// Cancelling ctx, for example with signal.NotifyContext, stops Serve even while
+// it is waiting for input.
+package apt
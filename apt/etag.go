@@ -0,0 +1,148 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// etagEntry is the metadata recorded for a URI after a successful download.
+type etagEntry struct {
+	URI          string `json:"uri"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+}
+
+// etagStore is a sidecar store of response ETags, keyed by apt URI. Each entry
+// is a small JSON file named after the SHA256 of the URI.
+type etagStore struct {
+	dir string
+}
+
+func (s etagStore) path(uri string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(uri))))
+}
+
+// get returns the entry for `uri`, or false if there is none.
+func (s etagStore) get(uri string) (etagEntry, bool) {
+	var entry etagEntry
+	data, err := os.ReadFile(s.path(uri))
+	if err != nil {
+		return entry, false
+	}
+	if err := json.Unmarshal(data, &entry); err != nil || entry.URI != uri || entry.ETag == "" {
+		return entry, false
+	}
+	return entry, true
+}
+
+// put atomically records the ETag and Last-Modified returned for `uri`.
+func (s etagStore) put(entry etagEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(entry.URI))
+}
+
+// remove drops any entry for `uri`.
+func (s etagStore) remove(uri string) error {
+	if err := os.Remove(s.path(uri)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// etags returns the ETag store under State-Dir, or false if no State-Dir is
+// configured, in which case ETags aren't used. apt owns the directories it
+// downloads to, so the store is never kept there.
+func (m *Method) etags() (etagStore, bool) {
+	if m.config.stateDir == "" {
+		return etagStore{}, false
+	}
+	return etagStore{dir: filepath.Join(m.config.stateDir, "etags")}, true
+}
+
+// conditionalHeaders returns the headers for a conditional request for `uri`.
+// apt only sends Last-Modified when it already has a copy of the file, so an
+// ETag is only used when it was recorded alongside that same Last-Modified,
+// which guarantees a 304 refers to the file apt has.
+func (m *Method) conditionalHeaders(uri, ifModifiedSince string) http.Header {
+	header := make(http.Header)
+	if ifModifiedSince == "" {
+		return header
+	}
+	// TODO(hopkiw): validate this string is in RFC1123Z format.
+	header.Set("If-Modified-Since", ifModifiedSince)
+
+	store, ok := m.etags()
+	if !ok {
+		return header
+	}
+	entry, ok := store.get(uri)
+	if !ok {
+		return header
+	}
+	stored, err := http.ParseTime(entry.LastModified)
+	if err != nil {
+		return header
+	}
+	requested, err := http.ParseTime(ifModifiedSince)
+	if err != nil || !stored.Equal(requested) {
+		return header
+	}
+	header.Set("If-None-Match", entry.ETag)
+	return header
+}
+
+// recordETag stores or clears the ETag after a successful download of `uri`.
+func (m *Method) recordETag(uri string, resp *http.Response) {
+	store, ok := m.etags()
+	if !ok {
+		return
+	}
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	var err error
+	if etag == "" || lastModified == "" {
+		err = store.remove(uri)
+	} else {
+		err = store.put(etagEntry{URI: uri, ETag: etag, LastModified: lastModified})
+	}
+	if err != nil {
+		m.writer.Log(fmt.Sprintf("failed to update ETag for %s: %v", uri, err))
+	}
+}
@@ -0,0 +1,136 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestETagStore(t *testing.T) {
+	store := etagStore{dir: filepath.Join(t.TempDir(), "etags")}
+	if _, ok := store.get("ar+https://fake.uri/InRelease"); ok {
+		t.Errorf("failed, expected no entry in empty store")
+	}
+	entry := etagEntry{URI: "ar+https://fake.uri/InRelease", ETag: `"abc"`, LastModified: "Mon, 01 Mar 2021 03:05:06 GMT"}
+	if err := store.put(entry); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	if res, ok := store.get(entry.URI); !ok || res != entry {
+		t.Errorf("failed, expected: %v got: %v", entry, res)
+	}
+	if _, ok := store.get("ar+https://fake.uri/Release"); ok {
+		t.Errorf("failed, expected no entry for other URI")
+	}
+	if err := store.remove(entry.URI); err != nil {
+		t.Fatalf("failed to remove: %v", err)
+	}
+	if _, ok := store.get(entry.URI); ok {
+		t.Errorf("failed, expected no entry after remove")
+	}
+}
+
+func TestHandleAcquireETag(t *testing.T) {
+	var requests []*http.Request
+	header := map[string][]string{
+		"Content-Length": {"200"},
+		"Last-Modified":  {"Mon, 01 Mar 2021 03:05:06 GMT"},
+		"Etag":           {`"abc"`},
+	}
+	var buffer bytes.Buffer
+	method := &Method{
+		config: &aptMethodConfig{stateDir: t.TempDir()},
+		writer: NewAptMessageWriter(&buffer),
+		client: fakeHTTPClient{header: header, requests: &requests},
+		dl:     fakeDownloader{},
+	}
+	req := &URIAcquire{
+		URI:       "ar+https://fake.uri/InRelease",
+		Filename:  "/path/to/file",
+		IndexFile: true,
+	}
+
+	// The first download records the ETag.
+	if err := method.handleAcquire(context.Background(), req); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if requests[0].Header.Get("If-None-Match") != "" {
+		t.Errorf("failed, unexpected If-None-Match on first request")
+	}
+
+	// Once apt has the file, it sends Last-Modified and we send the ETag.
+	req.LastModified = "Mon, 01 Mar 2021 03:05:06 GMT"
+	method.client = fakeHTTPClient{code: 304, header: header, requests: &requests}
+	buffer.Reset()
+	if err := method.handleAcquire(context.Background(), req); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if requests[1].Header.Get("If-None-Match") != `"abc"` {
+		t.Errorf("failed, expected If-None-Match %q, got %q", `"abc"`, requests[1].Header.Get("If-None-Match"))
+	}
+	if !strings.Contains(buffer.String(), "IMS-Hit: true") {
+		t.Errorf("failed, expected IMS hit in %q", buffer.String())
+	}
+
+	// An ETag recorded for a different Last-Modified is not used.
+	req.LastModified = "Tue, 02 Mar 2021 03:05:06 GMT"
+	if err := method.handleAcquire(context.Background(), req); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if requests[2].Header.Get("If-None-Match") != "" {
+		t.Errorf("failed, unexpected If-None-Match for mismatched Last-Modified")
+	}
+	if requests[2].Header.Get("If-Modified-Since") != "Tue, 02 Mar 2021 03:05:06 GMT" {
+		t.Errorf("failed, expected If-Modified-Since to be sent")
+	}
+}
+
+func TestHandleAcquireETagNoStateDir(t *testing.T) {
+	dir := t.TempDir()
+	var requests []*http.Request
+	method := &Method{
+		config: &aptMethodConfig{},
+		writer: NewAptMessageWriter(io.Discard),
+		client: fakeHTTPClient{header: map[string][]string{
+			"Content-Length": {"200"},
+			"Last-Modified":  {"Mon, 01 Mar 2021 03:05:06 GMT"},
+			"Etag":           {`"abc"`},
+		}, requests: &requests},
+		dl: fakeDownloader{},
+	}
+	req := &URIAcquire{
+		URI:       "ar+https://fake.uri/InRelease",
+		Filename:  filepath.Join(dir, "InRelease"),
+		IndexFile: true,
+	}
+	for _, lastModified := range []string{"", "Mon, 01 Mar 2021 03:05:06 GMT"} {
+		req.LastModified = lastModified
+		if err := method.handleAcquire(context.Background(), req); err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+	}
+	if requests[1].Header.Get("If-None-Match") != "" {
+		t.Errorf("failed, unexpected If-None-Match without a State-Dir")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("failed, expected nothing written next to the download, got %v", entries)
+	}
+}
@@ -0,0 +1,368 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Debug levels, as set by Debug::Acquire::gar. Each includes the ones below.
+const (
+	// debugRequests logs each request and the outcome of each acquire.
+	debugRequests = 1
+	// debugHeaders adds request and response headers.
+	debugHeaders = 2
+	// debugWire adds connection events and dumps of each request and
+	// response.
+	debugWire = 3
+)
+
+// The slog levels of the records for each debug level.
+const (
+	levelRequests = slog.LevelInfo
+	levelHeaders  = slog.LevelDebug
+	levelWire     = slog.LevelDebug - 4
+)
+
+// Log formats accepted by Log-Format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logs reports whether records at `level` are wanted under `c`. Records of
+// each acquire are always wanted in a Log-File, which exists to collect them.
+func (c *aptMethodConfig) logs(level slog.Level) bool {
+	switch {
+	case c.debugLevel >= debugWire:
+		return level >= levelWire
+	case c.debugLevel == debugHeaders:
+		return level >= levelHeaders
+	case c.debugLevel == debugRequests || c.logFile != "":
+		return level >= levelRequests
+	}
+	return false
+}
+
+// aptLogWriter sends each record written by a slog handler to apt as a 101
+// Log message.
+type aptLogWriter struct {
+	writer *MessageWriter
+}
+
+func (w aptLogWriter) Write(p []byte) (int, error) {
+	if err := w.writer.Log(strings.TrimRight(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// log returns the method's logger. Until a Log-File is configured, records
+// are sent to apt, which shows them when debugging methods.
+func (m *Method) log() *slog.Logger {
+	if m.logger == nil {
+		m.logger = slog.New(slog.NewTextHandler(aptLogWriter{m.writer}, &slog.HandlerOptions{Level: levelWire}))
+	}
+	return m.logger
+}
+
+// openLog switches the logger to the configured Log-File and Log-Format,
+// closing any previous file.
+func (m *Method) openLog() error {
+	path, format := m.config.logFile, m.config.logFormat
+	if m.logFile != nil && m.logFile.Name() == path && m.logFormat == format {
+		return nil
+	}
+	m.closeLog()
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	opts := &slog.HandlerOptions{Level: levelWire}
+	if format == logFormatJSON {
+		m.logger = slog.New(slog.NewJSONHandler(f, opts))
+	} else {
+		m.logger = slog.New(slog.NewTextHandler(f, opts))
+	}
+	m.logFile, m.logFormat = f, format
+	return nil
+}
+
+// closeLog closes the Log-File, if open, and reverts to logging to apt.
+func (m *Method) closeLog() {
+	if m.logFile != nil {
+		m.logFile.Close()
+	}
+	m.logFile, m.logFormat, m.logger = nil, "", nil
+}
+
+// acquireRecord is the outcome of one acquire, logged once it completes.
+type acquireRecord struct {
+	start time.Time
+	// status is the HTTP status of the final response, if any.
+	status   int
+	bytes    int64
+	retries  int
+	cacheHit bool
+	// host is the host which served the response, and sha256 the digest of
+	// the file apt was given.
+	host   string
+	sha256 string
+	// timing is recorded in debug mode.
+	timing *requestTiming
+}
+
+// logAcquire logs the outcome of acquiring `uri`.
+func (m *Method) logAcquire(ctx context.Context, config *aptMethodConfig, uri string, rec *acquireRecord, err error) {
+	if !config.logs(levelRequests) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("uri", uri),
+		slog.Int("status", rec.status),
+		slog.Int64("bytes", rec.bytes),
+		slog.Duration("duration", time.Since(rec.start)),
+		slog.Int("retries", rec.retries),
+	}
+	// Files from the download cache are served without credentials.
+	if rec.cacheHit {
+		attrs = append(attrs, slog.Bool("cache_hit", true))
+	} else {
+		attrs = append(attrs, slog.String("principal", m.principal))
+	}
+	if rec.timing != nil && rec.status != 0 {
+		attrs = append(attrs, rec.timing.attr())
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+		m.log().LogAttrs(ctx, levelRequests, "acquire failed", attrs...)
+		return
+	}
+	m.log().LogAttrs(ctx, levelRequests, "acquire", attrs...)
+}
+
+// debugTransport logs the requests `next` sends and the responses it receives
+// at the levels the configuration for each host asks for. It sits beneath the
+// oauth2.Transport, so it sees the headers which are actually sent. Secrets in
+// them, and the signatures of signed URLs, are redacted.
+type debugTransport struct {
+	m    *Method
+	next http.RoundTripper
+}
+
+func (t debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	config := t.m.config.forHost(req.URL.Hostname())
+	wire, headers := config.logs(levelWire), config.logs(levelHeaders)
+	if wire || headers {
+		redacted := req.Clone(ctx)
+		redacted.Header = redactHeader(req.Header)
+		redacted.URL = redactURL(req.URL)
+		if wire {
+			if dump, err := httputil.DumpRequest(redacted, false); err == nil {
+				t.m.log().LogAttrs(ctx, levelWire, "request dump", slog.String("dump", string(dump)))
+			}
+		} else {
+			t.m.log().LogAttrs(ctx, levelHeaders, "request headers", slog.String("url", redacted.URL.String()), slog.Any("header", redacted.Header))
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || !(wire || headers) {
+		return resp, err
+	}
+	redacted := *resp
+	redacted.Header = redactHeader(resp.Header)
+	if wire {
+		if dump, err := httputil.DumpResponse(&redacted, false); err == nil {
+			t.m.log().LogAttrs(ctx, levelWire, "response dump", slog.String("dump", string(dump)))
+		}
+	} else {
+		t.m.log().LogAttrs(ctx, levelHeaders, "response headers", slog.String("url", redactURL(req.URL).String()), slog.Int("status", resp.StatusCode), slog.Any("header", redacted.Header))
+	}
+	return resp, nil
+}
+
+// redactedValue replaces secrets in logs.
+const redactedValue = "REDACTED"
+
+// secretHeaders are the headers whose values are always redacted.
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// redactHeader returns a copy of `h` with secrets redacted, including the
+// signature of a signed URL in Location.
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, key := range secretHeaders {
+		if _, ok := h[key]; ok {
+			h[key] = []string{redactedValue}
+		}
+	}
+	for i, location := range h["Location"] {
+		if u, err := url.Parse(location); err == nil {
+			h["Location"][i] = redactURL(u).String()
+		}
+	}
+	return h
+}
+
+// redactURL returns `u` with the values of any X-Goog-* query parameters,
+// which sign Cloud Storage URLs, redacted.
+func redactURL(u *url.URL) *url.URL {
+	if u.RawQuery == "" {
+		return u
+	}
+	query := u.Query()
+	changed := false
+	for key := range query {
+		if hasPrefixFold(key, "X-Goog-") {
+			query[key] = []string{redactedValue}
+			changed = true
+		}
+	}
+	if !changed {
+		return u
+	}
+	r := *u
+	r.RawQuery = query.Encode()
+	return &r
+}
+
+// redactError redacts the URL in errors from http.Client, which may be a
+// signed URL the client was redirected to.
+func redactError(err error) error {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return err
+	}
+	u, parseErr := url.Parse(urlErr.URL)
+	if parseErr != nil {
+		return err
+	}
+	return &url.Error{Op: urlErr.Op, URL: redactURL(u).String(), Err: urlErr.Err}
+}
+
+// requestTiming breaks down the latency of the request which got the response
+// to an acquire. Its times are recorded by the trace from clientTrace, whose
+// hooks may be called from the transport's goroutines.
+type requestTiming struct {
+	mu                        sync.Mutex
+	start                     time.Time
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	firstByte                 time.Time
+	reused                    bool
+	transfer                  time.Duration
+}
+
+// clientTrace returns a trace recording the times of each request. As the
+// response comes from the last request made, each restarts the timing.
+func (t *requestTiming) clientTrace() *httptrace.ClientTrace {
+	now := func(field *time.Time) func() {
+		return func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			*field = time.Now()
+		}
+	}
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart, t.dnsDone = time.Time{}, time.Time{}
+			t.connectStart, t.connectDone = time.Time{}, time.Time{}
+			t.tlsStart, t.tlsDone = time.Time{}, time.Time{}
+			t.firstByte, t.reused = time.Time{}, false
+			t.start = time.Now()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.reused = info.Reused
+		},
+		DNSStart: func(httptrace.DNSStartInfo) { now(&t.dnsStart)() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { now(&t.dnsDone)() },
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			// Several addresses may be tried; the first attempt starts the
+			// connection.
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				now(&t.connectDone)()
+			}
+		},
+		TLSHandshakeStart:    now(&t.tlsStart),
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { now(&t.tlsDone)() },
+		GotFirstResponseByte: now(&t.firstByte),
+	}
+}
+
+// since returns the time from `start` to `end`, or 0 if either didn't happen.
+func since(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// durations returns the times taken to look up the host, connect, complete
+// the TLS handshake, receive the first byte of the response from the start
+// of the request, and transfer the body, and whether the connection was
+// reused.
+func (t *requestTiming) durations() (dns, connect, tls, ttfb, transfer time.Duration, reused bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return since(t.dnsStart, t.dnsDone), since(t.connectStart, t.connectDone), since(t.tlsStart, t.tlsDone), since(t.start, t.firstByte), t.transfer, t.reused
+}
+
+// String formats the timing compactly, as logged to apt.
+func (t *requestTiming) String() string {
+	dns, connect, tls, ttfb, transfer, reused := t.durations()
+	ms := func(d time.Duration) string { return d.Round(time.Millisecond).String() }
+	return fmt.Sprintf("dns=%s connect=%s tls=%s ttfb=%s transfer=%s reused=%v", ms(dns), ms(connect), ms(tls), ms(ttfb), ms(transfer), reused)
+}
+
+// attr returns the timing as an attribute of structured records.
+func (t *requestTiming) attr() slog.Attr {
+	dns, connect, tls, ttfb, transfer, reused := t.durations()
+	return slog.Group("timing",
+		slog.Duration("dns", dns),
+		slog.Duration("connect", connect),
+		slog.Duration("tls", tls),
+		slog.Duration("ttfb", ttfb),
+		slog.Duration("transfer", transfer),
+		slog.Bool("reused", reused))
+}
@@ -0,0 +1,335 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestDebugLevels(t *testing.T) {
+	var tests = []struct {
+		value   string
+		level   int
+		invalid bool
+	}{
+		{"0", 0, false},
+		{"1", 1, false},
+		{"2", 2, false},
+		{"3", 3, false},
+		{"true", 1, false},
+		{"off", 0, false},
+		{"4", 0, true},
+		{"-1", 0, true},
+		{"lots", 0, true},
+	}
+	for _, tt := range tests {
+		config, errs := buildConfig([]configItem{{debugConfigKey, tt.value, aptConfigSource}})
+		if config.debugLevel != tt.level || (len(errs) > 0) != tt.invalid {
+			t.Errorf("%q failed, expected: level %d invalid %v got: level %d errors %v", tt.value, tt.level, tt.invalid, config.debugLevel, errs)
+		}
+	}
+}
+
+func TestConfigLogs(t *testing.T) {
+	var tests = []struct {
+		config                  aptMethodConfig
+		requests, headers, wire bool
+	}{
+		{aptMethodConfig{}, false, false, false},
+		{aptMethodConfig{logFile: "/var/log/gar.log"}, true, false, false},
+		{aptMethodConfig{debugLevel: 1}, true, false, false},
+		{aptMethodConfig{debugLevel: 2}, true, true, false},
+		{aptMethodConfig{debugLevel: 3, logFile: "/var/log/gar.log"}, true, true, true},
+	}
+	for _, tt := range tests {
+		requests, headers, wire := tt.config.logs(levelRequests), tt.config.logs(levelHeaders), tt.config.logs(levelWire)
+		if requests != tt.requests || headers != tt.headers || wire != tt.wire {
+			t.Errorf("%+v failed, expected: %v %v %v got: %v %v %v", tt.config, tt.requests, tt.headers, tt.wire, requests, headers, wire)
+		}
+	}
+}
+
+func TestHandleAcquireLogFile(t *testing.T) {
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = 0
+
+	logFile := filepath.Join(t.TempDir(), "gar.log")
+	var buffer bytes.Buffer
+	method := &Method{
+		config:    &aptMethodConfig{},
+		writer:    NewAptMessageWriter(&buffer),
+		client:    fakeHTTPClient{failures: 1, requests: new([]*http.Request)},
+		dl:        fakeDownloader{},
+		principal: "apt@project.iam.gserviceaccount.com",
+	}
+	method.handleConfigure(&Configuration{ConfigItems: []string{
+		"Acquire::gar::Log-File=" + logFile,
+		"Acquire::gar::Log-Format=json",
+		"Acquire::gar::Retries=1",
+	}})
+	if err := method.handleAcquire(context.Background(), &URIAcquire{URI: "ar+https://fake.uri/file", Filename: "/path/to/file"}); err != nil {
+		t.Fatalf("handleAcquire failed: %v", err)
+	}
+	method.closeLog()
+
+	f, err := os.Open(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []map[string]any
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("failed, invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		t.Fatal("failed, expected records in the log file")
+	}
+
+	acquire := records[len(records)-1]
+	expected := map[string]any{
+		"msg":       "acquire",
+		"uri":       "ar+https://fake.uri/file",
+		"status":    float64(200),
+		"bytes":     float64(200),
+		"retries":   float64(1),
+		"principal": "apt@project.iam.gserviceaccount.com",
+	}
+	for key, value := range expected {
+		if acquire[key] != value {
+			t.Errorf("failed, expected: %s=%v got: %v", key, value, acquire[key])
+		}
+	}
+	if _, ok := acquire["duration"]; !ok {
+		t.Errorf("failed, expected a duration in %v", acquire)
+	}
+	if strings.Contains(buffer.String(), `msg=acquire`) {
+		t.Errorf("failed, records should only go to the log file, got %q", buffer.String())
+	}
+}
+
+func TestHandleAcquireLogFileRedactsError(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "gar.log")
+	var buffer bytes.Buffer
+	method := &Method{
+		config: &aptMethodConfig{logFile: logFile, debugLevel: debugRequests},
+		writer: NewAptMessageWriter(&buffer),
+		client: fakeHTTPClient{err: &url.Error{
+			Op:  "Get",
+			URL: "https://storage.googleapis.com/b/o?X-Goog-Signature=signature-secret",
+			Err: errors.New("connection reset by peer"),
+		}},
+		dl: fakeDownloader{},
+	}
+	if err := method.openLog(); err != nil {
+		t.Fatal(err)
+	}
+	err := method.handleAcquire(context.Background(), &URIAcquire{URI: "ar+https://fake.uri/file", Filename: "/path/to/file"})
+	method.closeLog()
+	if err == nil || strings.Contains(err.Error(), "signature-secret") {
+		t.Errorf("failed, expected a redacted error got: %v", err)
+	}
+
+	data, readErr := os.ReadFile(logFile)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if !strings.Contains(string(data), "acquire failed") || !strings.Contains(string(data), "X-Goog-Signature=REDACTED") {
+		t.Errorf("failed, expected the redacted failure to be logged in %q", data)
+	}
+	for _, logged := range []string{string(data), buffer.String()} {
+		if strings.Contains(logged, "signature-secret") {
+			t.Errorf("failed, signature was logged in %q", logged)
+		}
+	}
+}
+
+func TestHandleAcquireLogToApt(t *testing.T) {
+	for _, level := range []int{0, 1} {
+		var buffer bytes.Buffer
+		method := &Method{
+			config: &aptMethodConfig{debugLevel: level},
+			writer: NewAptMessageWriter(&buffer),
+			client: fakeHTTPClient{},
+			dl:     fakeDownloader{},
+		}
+		if err := method.handleAcquire(context.Background(), &URIAcquire{URI: "ar+https://fake.uri/file", Filename: "/path/to/file"}); err != nil {
+			t.Fatalf("handleAcquire failed: %v", err)
+		}
+		logged := strings.Contains(buffer.String(), "101 Log\nMessage: time=")
+		if logged != (level > 0) {
+			t.Errorf("level %d failed, expected logging %v got: %q", level, level > 0, buffer.String())
+		}
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	var tests = []struct {
+		url, expected string
+	}{
+		{"https://us-apt.pkg.dev/projects/p/dists/stable/InRelease", "https://us-apt.pkg.dev/projects/p/dists/stable/InRelease"},
+		{"https://host/file?a=b&c=d", "https://host/file?a=b&c=d"},
+		{
+			"https://storage.googleapis.com/b/o?X-Goog-Algorithm=GOOG4-RSA-SHA256&X-Goog-Credential=sa%40p&x-goog-signature=abc123&generation=1",
+			"https://storage.googleapis.com/b/o?X-Goog-Algorithm=REDACTED&X-Goog-Credential=REDACTED&generation=1&x-goog-signature=REDACTED",
+		},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := redactURL(u).String(); got != tt.expected {
+			t.Errorf("failed, expected: %s got: %s", tt.expected, got)
+		}
+	}
+}
+
+func TestDebugTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=cookie-secret")
+		w.Header().Set("Location", "https://storage.googleapis.com/b/o?X-Goog-Signature=signature-secret")
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer server.Close()
+
+	for _, level := range []int{debugHeaders, debugWire} {
+		var buffer bytes.Buffer
+		method := &Method{config: &aptMethodConfig{debugLevel: level}, writer: NewAptMessageWriter(&buffer)}
+		client := &http.Client{
+			Transport: &oauth2.Transport{
+				Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token-secret"}),
+				Base:   debugTransport{method, http.DefaultTransport},
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		req, _ := http.NewRequest("GET", server.URL+"/file", nil)
+		req.Header.Set("Cookie", "session=cookie-secret")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		logged := buffer.String()
+		for _, secret := range []string{"token-secret", "cookie-secret", "signature-secret"} {
+			if strings.Contains(logged, secret) {
+				t.Errorf("level %d failed, %s was logged in %q", level, secret, logged)
+			}
+		}
+		for _, expected := range []string{"Authorization", "REDACTED", "X-Goog-Signature=REDACTED"} {
+			if !strings.Contains(logged, expected) {
+				t.Errorf("level %d failed, expected %q to be logged in %q", level, expected, logged)
+			}
+		}
+	}
+}
+
+func TestRequestTiming(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+	client := server.Client()
+
+	for i, reused := range []bool{false, true} {
+		timing := &requestTiming{}
+		ctx := httptrace.WithClientTrace(context.Background(), timing.clientTrace())
+		req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		_, connect, tls, ttfb, _, gotReused := timing.durations()
+		if gotReused != reused || (connect > 0) == reused || (tls > 0) == reused || ttfb <= 0 {
+			t.Errorf("request %d failed, expected reused %v got: %s", i, reused, timing)
+		}
+	}
+}
+
+func TestHandleAcquireTiming(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		level          int
+		logFile        bool
+		line, recorded bool
+	}{
+		{0, false, false, false},
+		{1, false, false, true},
+		{1, true, true, false},
+	} {
+		dir := t.TempDir()
+		var buffer bytes.Buffer
+		method := &Method{
+			config: &aptMethodConfig{debugLevel: tt.level},
+			writer: NewAptMessageWriter(&buffer),
+			client: server.Client(),
+			dl:     downloaderImpl{},
+		}
+		if tt.logFile {
+			method.config.logFile = filepath.Join(dir, "gar.log")
+			if err := method.openLog(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		uri := "ar+https://" + server.Listener.Addr().String() + "/file"
+		if err := method.handleAcquire(context.Background(), &URIAcquire{URI: uri, Filename: filepath.Join(dir, "file")}); err != nil {
+			t.Fatalf("handleAcquire failed: %v", err)
+		}
+		method.closeLog()
+
+		// apt gets the timing once, either as a line of its own or in the
+		// acquire record.
+		line := strings.Contains(buffer.String(), "Message: timing "+uri+": dns=")
+		if line != tt.line || (tt.line && !strings.Contains(buffer.String(), "transfer=")) {
+			t.Errorf("level %d failed, expected timing line %v got: %q", tt.level, tt.line, buffer.String())
+		}
+		if recorded := strings.Contains(buffer.String(), "timing.ttfb="); recorded != tt.recorded {
+			t.Errorf("level %d failed, expected timing in the acquire record %v got: %q", tt.level, tt.recorded, buffer.String())
+		}
+		if tt.logFile {
+			if data, _ := os.ReadFile(method.config.logFile); !strings.Contains(string(data), "timing.ttfb=") {
+				t.Errorf("level %d failed, expected timing in the log file, got: %q", tt.level, data)
+			}
+		}
+	}
+}
@@ -17,102 +17,131 @@ package apt
 import (
 	"fmt"
 	"regexp"
-	"sort"
 	"strings"
 )
 
 var newlineRegexp = regexp.MustCompile(`\r?\n`)
 
-// Message represents a single RFC822 Apt message.
+// knownFields maps the lowercased names of fields used by apt to their
+// canonical spelling.
+var knownFields = make(map[string]string)
+
+func init() {
+	for _, key := range []string{
+		"Alt-URIs", "AuxRequests", "Checksum-FileSize-Hash", "Config-Item",
+		"Expected-Checksum-FileSize", "Expected-MD5", "Expected-MD5Sum",
+		"Expected-SHA1", "Expected-SHA256", "Expected-SHA512", "Fail-Ignore",
+		"FailReason", "Filename", "IMS-Hit", "Index-File", "Last-Modified",
+		"Local-Only", "Maximum-Size", "MD5-Hash", "MD5Sum-Hash", "Message",
+		"Needs-Cleanup", "New-URI", "Pipeline", "Proxy-Auto-Detect",
+		"Removable", "Resume-Point", "Send-Config", "Send-URI-Encoded",
+		"SHA1-Hash", "SHA256-Hash", "SHA512-Hash", "Single-Instance", "Size",
+		"Target-Base-URI", "Target-Component", "Target-Release",
+		"Target-Repo-URI", "Target-Site", "Transient", "URI", "Used-Mirror",
+		"Version",
+	} {
+		knownFields[strings.ToLower(key)] = key
+	}
+}
+
+// canonicalKey returns the canonical spelling of a field name. Field names
+// are case-insensitive; unknown names are returned unchanged.
+func canonicalKey(key string) string {
+	if canonical, ok := knownFields[strings.ToLower(key)]; ok {
+		return canonical
+	}
+	return key
+}
+
+// field is a single "Key: Value" line of a Message.
+type field struct {
+	key, value string
+}
+
+// Message represents a single RFC822 Apt message. Fields are kept in the
+// order they were added, and looked up case-insensitively.
 type Message struct {
 	code        int
 	description string
-	fields      map[string][]string
+	fields      []field
 }
 
 // Get returns the first AptMessage Field for `key`, or "".
 func (m *Message) Get(key string) string {
-	if vals, ok := m.fields[key]; ok {
-		if len(vals) > 0 {
-			return vals[0]
+	for _, f := range m.fields {
+		if strings.EqualFold(f.key, key) {
+			return f.value
 		}
 	}
 	return ""
 }
 
-func (m *Message) String() string {
-	// Map iteration is unordered. For testing convenience, write alphabetical output.
-	sortedKeys := make([]string, len(m.fields))
-	i := 0
-	for key := range m.fields {
-		sortedKeys[i] = key
-		i++
-	}
-	sort.Strings(sortedKeys)
-
-	message := []string{fmt.Sprintf("%d %s", m.code, m.description)}
-	for _, key := range sortedKeys {
-		for _, val := range m.fields[key] {
-			// Messages are allowed to contain newlines, but they must not contain double newlines,
-			// nor end in a newline (since this would result in a premature double newline). We'll
-			// encode all newlines here as a space instead for simplicity.
-			val = newlineRegexp.ReplaceAllString(val, " ")
-
-			message = append(message, fmt.Sprintf("%s: %s", key, val))
+// Values returns every value of the field `key`, in order.
+func (m *Message) Values(key string) []string {
+	var values []string
+	for _, f := range m.fields {
+		if strings.EqualFold(f.key, key) {
+			values = append(values, f.value)
 		}
 	}
-	message = append(message, "")
-	message = append(message, "") // End with a newline.
-	return strings.Join(message, "\n")
+	return values
 }
 
-func new100Message() Message {
-	fields := make(map[string][]string)
-	fields["Send-Config"] = []string{"true"}
-	fields["Version"] = []string{"1.0"}
-	return Message{code: 100, description: "Capabilities", fields: fields}
+// Add appends a value for `key`, after any existing values.
+func (m *Message) Add(key, value string) {
+	m.fields = append(m.fields, field{key: canonicalKey(key), value: value})
 }
 
-func new101Message(msg string) Message {
-	fields := make(map[string][]string)
-	fields["Message"] = []string{msg}
-	return Message{code: 101, description: "Log", fields: fields}
+// Set replaces any values for `key` with a single value. The field keeps the
+// position of its first existing value, if any.
+func (m *Message) Set(key, value string) {
+	for i, f := range m.fields {
+		if strings.EqualFold(f.key, key) {
+			m.fields[i].value = value
+			m.fields = append(m.fields[:i+1], removeFields(m.fields[i+1:], key)...)
+			return
+		}
+	}
+	m.Add(key, value)
 }
 
-func new200Message(uri, size, lastModified string) Message {
-	fields := make(map[string][]string)
-	fields["URI"] = []string{uri}
-	fields["Size"] = []string{size}
-	if lastModified != "" {
-		fields["Last-Modified"] = []string{lastModified}
-	}
-	fields["Resume-Point"] = []string{"0"}
-	return Message{code: 200, description: "URI Start", fields: fields}
+// Del removes all values for `key`.
+func (m *Message) Del(key string) {
+	m.fields = removeFields(m.fields, key)
 }
 
-func new201Message(uri, size, lastModified, md5Hash, filename string, imsHit bool) Message {
-	fields := make(map[string][]string)
-	fields["URI"] = []string{uri}
-	fields["Last-Modified"] = []string{lastModified}
-	fields["Filename"] = []string{filename}
-	if imsHit {
-		fields["IMS-Hit"] = []string{"true"}
-	} else {
-		fields["Size"] = []string{size}
-		fields["MD5-Hash"] = []string{md5Hash}
+// removeFields filters out every field named `key`, reusing the backing array.
+func removeFields(fields []field, key string) []field {
+	kept := fields[:0]
+	for _, f := range fields {
+		if !strings.EqualFold(f.key, key) {
+			kept = append(kept, f)
+		}
 	}
-	return Message{code: 201, description: "URI Done", fields: fields}
+	return kept
 }
 
-func new400Message(uri, msg string) Message {
-	fields := make(map[string][]string)
-	fields["URI"] = []string{uri}
-	fields["Message"] = []string{msg}
-	return Message{code: 400, description: "URI Failure", fields: fields}
+func (m *Message) String() string {
+	message := []string{fmt.Sprintf("%d %s", m.code, m.description)}
+	for _, f := range m.fields {
+		message = append(message, foldField(f.key, f.value))
+	}
+	message = append(message, "")
+	message = append(message, "") // End with a newline.
+	return strings.Join(message, "\n")
 }
 
-func new401Message(msg string) Message {
-	fields := make(map[string][]string)
-	fields["Message"] = []string{msg}
-	return Message{code: 401, description: "General Failure", fields: fields}
+// foldField formats a field, folding multi-line values RFC822-style: each
+// subsequent line is indented by a space, and empty lines are written as " ."
+// so that a value can never produce the blank line which ends a message.
+func foldField(key, val string) string {
+	lines := newlineRegexp.Split(strings.Trim(val, "\r\n"), -1)
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == "" {
+			lines[i] = " ."
+		} else {
+			lines[i] = " " + lines[i]
+		}
+	}
+	return fmt.Sprintf("%s: %s", key, strings.Join(lines, "\n"))
 }
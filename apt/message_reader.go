@@ -19,16 +19,72 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 var errEmptyMessage = errors.New("empty message")
 
+// LimitError is returned by ReadMessage when a message exceeds one of the
+// reader's limits. The rest of the message is skipped, so the next call reads
+// the message after it.
+type LimitError struct {
+	Limit string
+}
+
+func (e *LimitError) Error() string {
+	return "apt: " + e.Limit + " exceeded"
+}
+
+// The errors returned for each limit, wrapped with the limit's value.
+var (
+	ErrLineTooLong     = &LimitError{Limit: "maximum line length"}
+	ErrTooManyFields   = &LimitError{Limit: "maximum field count"}
+	ErrMessageTooLarge = &LimitError{Limit: "maximum message size"}
+)
+
+// ReaderLimits bounds the memory used to read a single message. A zero value
+// uses the corresponding default.
+type ReaderLimits struct {
+	// MaxLineLength is the maximum length of a line, in bytes.
+	MaxLineLength int
+	// MaxFields is the maximum number of fields, not counting continuation
+	// lines.
+	MaxFields int
+	// MaxMessageSize is the maximum total size of a message, in bytes.
+	MaxMessageSize int
+}
+
+// DefaultReaderLimits are generous enough for apt's 601 Configuration
+// message, which holds the whole apt configuration.
+var DefaultReaderLimits = ReaderLimits{
+	MaxLineLength:  1 << 20,
+	MaxFields:      1 << 16,
+	MaxMessageSize: 16 << 20,
+}
+
 // MessageReader supports reading Apt messages.
 type MessageReader struct {
 	reader  *bufio.Reader
 	message *Message
+	limits  ReaderLimits
+	// size is the number of bytes read for `message`.
+	size int
+	// discard is set after an error, until the blank line ending the
+	// offending message.
+	discard bool
+
+	// lines is fed by a goroutine blocked reading `reader`, so that reads can
+	// be abandoned when a context is done.
+	startOnce sync.Once
+	lines     chan readResult
+}
+
+type readResult struct {
+	line string
+	err  error
 }
 
 // NewAptMessageReader returns an AptMessageReader.
@@ -36,21 +92,37 @@ func NewAptMessageReader(r *bufio.Reader) *MessageReader {
 	return &MessageReader{reader: r}
 }
 
+// SetLimits sets the limits applied to messages. It must be called before the
+// first ReadMessage.
+func (r *MessageReader) SetLimits(limits ReaderLimits) {
+	r.limits = limits
+}
+
+// limit returns `value`, or `def` if it isn't set.
+func limit(value, def int) int {
+	if value > 0 {
+		return value
+	}
+	return def
+}
+
 // ReadMessage reads lines from `reader` until a complete message is received.
+// If the message is malformed or exceeds a limit, the rest of it is skipped
+// and an error is returned; a *LimitError for the latter.
 func (r *MessageReader) ReadMessage(ctx context.Context) (*Message, error) {
 	for {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		default:
-		}
-		line, err := r.reader.ReadString('\n')
-		if err != nil {
+		line, err := r.readLine(ctx)
+		if errors.Is(err, ErrLineTooLong) {
+			return nil, r.fail(err)
+		} else if err != nil {
 			return nil, err
 		}
 
-		line = strings.TrimSpace(line)
-		if line == "" {
+		if strings.TrimSpace(line) == "" {
+			if r.discard {
+				r.discard = false
+				continue
+			}
 			if r.message == nil {
 				return nil, errEmptyMessage
 			}
@@ -58,18 +130,97 @@ func (r *MessageReader) ReadMessage(ctx context.Context) (*Message, error) {
 			// Message is done, return and reset.
 			msg := r.message
 			r.message = nil
+			r.size = 0
 			return msg, nil
 		}
+		if r.discard {
+			continue
+		}
+		if err := r.parseLine(line); err != nil {
+			return nil, r.fail(err)
+		}
+	}
+}
 
-		if r.message == nil {
-			r.message = &Message{}
-			if err := r.parseHeader(line); err != nil {
-				return nil, err
+// parseLine adds a non-blank line to the current message.
+func (r *MessageReader) parseLine(line string) error {
+	r.size += len(line)
+	if n := limit(r.limits.MaxMessageSize, DefaultReaderLimits.MaxMessageSize); r.size > n {
+		return fmt.Errorf("%w (%d bytes)", ErrMessageTooLarge, n)
+	}
+
+	if r.message != nil && (line[0] == ' ' || line[0] == '\t') {
+		return r.parseContinuation(line)
+	}
+
+	line = strings.TrimSpace(line)
+	if r.message == nil {
+		r.message = &Message{}
+		return r.parseHeader(line)
+	}
+	if n := limit(r.limits.MaxFields, DefaultReaderLimits.MaxFields); len(r.message.fields) >= n {
+		return fmt.Errorf("%w (%d fields)", ErrTooManyFields, n)
+	}
+	return r.parseField(line)
+}
+
+// fail drops the current message and skips input until the next blank line.
+func (r *MessageReader) fail(err error) error {
+	r.message = nil
+	r.size = 0
+	r.discard = true
+	return err
+}
+
+// readLine returns the next line of input, or the context's error if it is
+// done first. A line arriving after cancellation is kept for the next call.
+func (r *MessageReader) readLine(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	r.startOnce.Do(func() {
+		r.lines = make(chan readResult)
+		go func() {
+			maxLen := limit(r.limits.MaxLineLength, DefaultReaderLimits.MaxLineLength)
+			for {
+				line, err := readBoundedLine(r.reader, maxLen)
+				r.lines <- readResult{line, err}
+				if err != nil && !errors.Is(err, ErrLineTooLong) {
+					close(r.lines)
+					return
+				}
+			}
+		}()
+	})
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case res, ok := <-r.lines:
+		if !ok {
+			return "", io.EOF
+		}
+		return res.line, res.err
+	}
+}
+
+// readBoundedLine reads a line of at most `maxLen` bytes, including the
+// newline, without buffering more than that. A longer line is discarded.
+func readBoundedLine(reader *bufio.Reader, maxLen int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLen {
+			for errors.Is(err, bufio.ErrBufferFull) {
+				_, err = reader.ReadSlice('\n')
 			}
-		} else {
-			if err := r.parseField(line); err != nil {
-				return nil, err
+			if err != nil {
+				return "", err
 			}
+			return "", fmt.Errorf("%w (%d bytes)", ErrLineTooLong, maxLen)
+		}
+		line = append(line, chunk...)
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return string(line), err
 		}
 	}
 }
@@ -105,17 +256,27 @@ func (r *MessageReader) parseField(line string) error {
 	if len(parts) < 2 {
 		return fmt.Errorf("malformed field %q, not enough parts", line)
 	}
-	if r.message.fields == nil {
-		r.message.fields = make(map[string][]string)
-	}
 	key := strings.TrimSpace(parts[0])
 	value := strings.TrimSpace(parts[1])
 	if key == "" || value == "" {
 		return fmt.Errorf("malformed field %q, empty key or value", line)
 	}
 
-	fieldlist := r.message.fields[key]
-	fieldlist = append(fieldlist, value)
-	r.message.fields[key] = fieldlist
+	r.message.Add(key, value)
+	return nil
+}
+
+// parseContinuation appends a folded line to the value of the previous field.
+// The single leading space or tab is removed, and a line of " ." denotes an
+// empty line.
+func (r *MessageReader) parseContinuation(line string) error {
+	if len(r.message.fields) == 0 {
+		return fmt.Errorf("malformed field %q, continuation line without a field", line)
+	}
+	line = strings.TrimRight(line[1:], " \t\r\n")
+	if line == "." {
+		line = ""
+	}
+	r.message.fields[len(r.message.fields)-1].value += "\n" + line
 	return nil
 }
@@ -18,6 +18,9 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
+	"io"
+	"strings"
 	"testing"
 )
 
@@ -28,19 +31,24 @@ func TestAptMessageGet(t *testing.T) {
 	}{
 		{
 			// Happy case.
-			Message{code: 123, description: "Fake", fields: map[string][]string{"key": {"val1", "val2"}}},
+			Message{code: 123, description: "Fake", fields: []field{{"key", "val1"}, {"key", "val2"}}},
 			"val1",
 		},
 		{
 			// Missing key.
-			Message{code: 123, description: "Fake", fields: map[string][]string{"some-other-key": {"val1", "val2"}}},
+			Message{code: 123, description: "Fake", fields: []field{{"some-other-key", "val1"}, {"some-other-key", "val2"}}},
 			"",
 		},
 		{
 			// Missing value.
-			Message{code: 123, description: "Fake", fields: map[string][]string{"key": {}}},
+			Message{code: 123, description: "Fake", fields: []field{}},
 			"",
 		},
+		{
+			// Keys are case-insensitive.
+			Message{code: 123, description: "Fake", fields: []field{{"KEY", "val1"}, {"key", "val2"}}},
+			"val1",
+		},
 	}
 
 	for _, tt := range tests {
@@ -50,6 +58,42 @@ func TestAptMessageGet(t *testing.T) {
 	}
 }
 
+func TestAptMessageFields(t *testing.T) {
+	m := Message{code: 123, description: "Fake"}
+	m.Add("uri", "val1")
+	m.Add("Field1", "val2")
+	m.Add("URI", "val3")
+	if res := m.Values("Uri"); len(res) != 2 || res[0] != "val1" || res[1] != "val3" {
+		t.Errorf("failed, expected values [val1 val3] got: %q", res)
+	}
+	if res := m.fields[0].key; res != "URI" {
+		t.Errorf("failed, expected canonical key %q got: %q", "URI", res)
+	}
+
+	// Set keeps the position of the first value and drops the rest.
+	m.Set("uri", "val4")
+	expected := []field{{"URI", "val4"}, {"Field1", "val2"}}
+	if !compareFields(m.fields, expected) {
+		t.Errorf("failed, expected: %v got: %v", expected, m.fields)
+	}
+
+	// Set appends a field which isn't present yet.
+	m.Set("Field2", "val5")
+	expected = append(expected, field{"Field2", "val5"})
+	if !compareFields(m.fields, expected) {
+		t.Errorf("failed, expected: %v got: %v", expected, m.fields)
+	}
+
+	m.Del("FIELD1")
+	expected = []field{{"URI", "val4"}, {"Field2", "val5"}}
+	if !compareFields(m.fields, expected) {
+		t.Errorf("failed, expected: %v got: %v", expected, m.fields)
+	}
+	if res := m.Values("Field1"); res != nil {
+		t.Errorf("failed, expected no values got: %q", res)
+	}
+}
+
 func TestAptWriterWriteMessage(t *testing.T) {
 	var tests = []struct {
 		message  Message
@@ -59,21 +103,22 @@ func TestAptWriterWriteMessage(t *testing.T) {
 			Message{
 				code:        123,
 				description: "Fake",
-				fields: map[string][]string{
-					"akey": {"val1", "val2"},
-					"zkey": {"val4"},
-					"Zkey": {"val3"},
+				fields: []field{
+					{"akey", "val1"},
+					{"akey", "val2"},
+					{"zkey", "val4"},
+					{"Zkey", "val3"},
 				},
 			},
-			// Capital letters before lowercase, then alphabetical.
-			"123 Fake\nZkey: val3\nakey: val1\nakey: val2\nzkey: val4\n\n",
+			// Fields are written in insertion order.
+			"123 Fake\nakey: val1\nakey: val2\nzkey: val4\nZkey: val3\n\n",
 		},
 		{
 			Message{
 				code: 123,
 				// Missing description.
-				fields: map[string][]string{
-					"akey": {"val1"},
+				fields: []field{
+					{"akey", "val1"},
 				},
 			},
 			"123 \nakey: val1\n\n",
@@ -82,8 +127,8 @@ func TestAptWriterWriteMessage(t *testing.T) {
 			Message{
 				// missing code.
 				description: "Fake",
-				fields: map[string][]string{
-					"akey": {"val1"},
+				fields: []field{
+					{"akey", "val1"},
 				},
 			},
 			"0 Fake\nakey: val1\n\n",
@@ -100,10 +145,7 @@ func TestAptWriterWriteMessage(t *testing.T) {
 			Message{
 				code:        123,
 				description: "Fake",
-				fields: map[string][]string{
-					// Missing field value.
-					"akey": {},
-				},
+				fields:      []field{},
 			},
 			"123 Fake\n\n",
 		},
@@ -111,12 +153,12 @@ func TestAptWriterWriteMessage(t *testing.T) {
 			Message{
 				code:        123,
 				description: "Fake",
-				fields: map[string][]string{
-					"akey": {"val ending with newline\n"},
-					"zkey": {"val containing \n\n double newlines"},
+				fields: []field{
+					{"akey", "val ending with newline\n"},
+					{"zkey", "val containing \n\n double newlines"},
 				},
 			},
-			"123 Fake\nakey: val ending with newline \nzkey: val containing    double newlines\n\n",
+			"123 Fake\nakey: val ending with newline\nzkey: val containing \n .\n  double newlines\n\n",
 		},
 	}
 
@@ -130,10 +172,72 @@ func TestAptWriterWriteMessage(t *testing.T) {
 	}
 }
 
+func TestAptWriterError(t *testing.T) {
+	writer := NewAptMessageWriter(&brokenWriter{n: 1})
+	if err := writer.Log("first"); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	select {
+	case <-writer.Done():
+		t.Fatalf("failed, writer done before an error")
+	default:
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := writer.Log("next"); !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("failed, expected io.ErrClosedPipe, got %v", err)
+		}
+	}
+	if err := writer.Err(); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("failed, expected io.ErrClosedPipe, got %v", err)
+	}
+	<-writer.Done()
+}
+
+func TestAptWriterSend(t *testing.T) {
+	var tests = []struct {
+		msg      TypedMessage
+		expected string
+	}{
+		{
+			Capabilities{Version: "1.0", SendConfig: true},
+			"100 Capabilities\nVersion: 1.0\nSend-Config: true\n\n",
+		},
+		{
+			Redirect{URI: "ar+https://fake.uri/debian/", NewURI: "https://other.uri/debian/"},
+			"103 Redirect\nURI: ar+https://fake.uri/debian/\nNew-URI: https://other.uri/debian/\n\n",
+		},
+		{
+			URIStart{URI: "http://fake.uri/debian/", Size: 419304, LastModified: "Mon, 01 Mar 2021 03:05:06 GMT"},
+			"200 URI Start\nURI: http://fake.uri/debian/\nSize: 419304\nLast-Modified: Mon, 01 Mar 2021 03:05:06 GMT\nResume-Point: 0\n\n",
+		},
+		{
+			URIDone{URI: "http://fake.uri/debian/", Filename: "/some/local/filename", LastModified: "Mon, 01 Mar 2021 03:05:06 GMT", Size: 419304, MD5Hash: "ABCDEFGHIJKL"},
+			"201 URI Done\nURI: http://fake.uri/debian/\nFilename: /some/local/filename\nLast-Modified: Mon, 01 Mar 2021 03:05:06 GMT\nSize: 419304\nMD5-Hash: ABCDEFGHIJKL\n\n",
+		},
+		{
+			URIDone{URI: "http://fake.uri/debian/", Filename: "/some/local/filename", LastModified: "Mon, 01 Mar 2021 03:05:06 GMT", IMSHit: true},
+			"201 URI Done\nURI: http://fake.uri/debian/\nFilename: /some/local/filename\nLast-Modified: Mon, 01 Mar 2021 03:05:06 GMT\nIMS-Hit: true\n\n",
+		},
+		{
+			URIFailure{URI: "http://fake.uri/debian/", Message: "uri failure message"},
+			"400 URI Failure\nURI: http://fake.uri/debian/\nMessage: uri failure message\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		writer := NewAptMessageWriter(&buffer)
+		if err := writer.Send(tt.msg); err != nil || buffer.String() != tt.expected {
+			t.Errorf("failed, expected:\n%q\ngot:\n%q", tt.expected, buffer.String())
+		}
+	}
+}
+
 func TestAptWriterSendCapabilities(t *testing.T) {
 	var buffer bytes.Buffer
 	writer := NewAptMessageWriter(&buffer)
-	expected := "100 Capabilities\nSend-Config: true\nVersion: 1.0\n\n"
+	expected := "100 Capabilities\nVersion: 1.0\nSend-Config: true\n\n"
 	if err := writer.SendCapabilities(); err != nil || buffer.String() != expected {
 		t.Errorf("failed, expected:\n%q\ngot:\n%q", expected, buffer.String())
 	}
@@ -157,6 +261,7 @@ func TestAptWriterLog(t *testing.T) {
 		}
 	}
 }
+
 func TestAptWriterURIStart(t *testing.T) {
 	var tests = []struct {
 		uri, size, lastModified, expected string
@@ -165,7 +270,7 @@ func TestAptWriterURIStart(t *testing.T) {
 			"http://fake.uri/debian/",
 			"419304",
 			"Mon, 01 Mar 2021 03:05:06 GMT",
-			"200 URI Start\nLast-Modified: Mon, 01 Mar 2021 03:05:06 GMT\nResume-Point: 0\nSize: 419304\nURI: http://fake.uri/debian/\n\n",
+			"200 URI Start\nURI: http://fake.uri/debian/\nSize: 419304\nLast-Modified: Mon, 01 Mar 2021 03:05:06 GMT\nResume-Point: 0\n\n",
 		},
 	}
 
@@ -190,7 +295,7 @@ func TestAptWriterURIDone(t *testing.T) {
 			"Mon, 01 Mar 2021 03:05:06 GMT",
 			"ABCDEFGHIJKL",
 			"/some/local/filename",
-			"201 URI Done\nFilename: /some/local/filename\nLast-Modified: Mon, 01 Mar 2021 03:05:06 GMT\nMD5-Hash: ABCDEFGHIJKL\nSize: 419304\nURI: http://fake.uri/debian/\n\n",
+			"201 URI Done\nURI: http://fake.uri/debian/\nFilename: /some/local/filename\nLast-Modified: Mon, 01 Mar 2021 03:05:06 GMT\nSize: 419304\nMD5-Hash: ABCDEFGHIJKL\n\n",
 			false,
 		},
 		{
@@ -199,7 +304,7 @@ func TestAptWriterURIDone(t *testing.T) {
 			"Mon, 01 Mar 2021 03:05:06 GMT",
 			"ABCDEFGHIJKL",
 			"/some/local/filename",
-			"201 URI Done\nFilename: /some/local/filename\nIMS-Hit: true\nLast-Modified: Mon, 01 Mar 2021 03:05:06 GMT\nURI: http://fake.uri/debian/\n\n",
+			"201 URI Done\nURI: http://fake.uri/debian/\nFilename: /some/local/filename\nLast-Modified: Mon, 01 Mar 2021 03:05:06 GMT\nIMS-Hit: true\n\n",
 			true,
 		},
 	}
@@ -220,7 +325,7 @@ func TestAptWriterFailURI(t *testing.T) {
 		{
 			"http://fake.uri/debian/",
 			"uri failure message",
-			"400 URI Failure\nMessage: uri failure message\nURI: http://fake.uri/debian/\n\n",
+			"400 URI Failure\nURI: http://fake.uri/debian/\nMessage: uri failure message\n\n",
 		},
 	}
 
@@ -252,20 +357,14 @@ func TestAptWriterFail(t *testing.T) {
 	}
 }
 
-func compareFields(first, second map[string][]string) bool {
+func compareFields(first, second []field) bool {
 	if len(first) != len(second) {
 		return false
 	}
-	for key, firstVals := range first {
-		secondVals, ok := second[key]
-		if !ok || len(firstVals) != len(secondVals) {
+	for idx, f := range first {
+		if f != second[idx] {
 			return false
 		}
-		for idx, firstVal := range firstVals {
-			if firstVal != secondVals[idx] {
-				return false
-			}
-		}
 	}
 	return true
 }
@@ -280,9 +379,23 @@ func TestAptReaderReadMessage(t *testing.T) {
 			Message{
 				code:        123,
 				description: "Fake Header",
-				fields: map[string][]string{
-					"Field1": {"val1", "val4"},
-					"Field2": {"val2", "val3"},
+				fields: []field{
+					{"Field1", "val1"},
+					{"Field2", "val2"},
+					{"Field2", "val3"},
+					{"Field1", "val4"},
+				},
+			},
+		},
+		{
+			// Continuation lines are joined onto the previous field.
+			"123 Fake Header\nField1: line1\n line2\n .\n\t line4\nField2: val2\n\n",
+			Message{
+				code:        123,
+				description: "Fake Header",
+				fields: []field{
+					{"Field1", "line1\nline2\n\n line4"},
+					{"Field2", "val2"},
 				},
 			},
 		},
@@ -304,6 +417,129 @@ func TestAptReaderReadMessage(t *testing.T) {
 	}
 }
 
+func TestAptReaderReadMessageFail(t *testing.T) {
+	var tests = []struct {
+		msg string
+	}{
+		{
+			// Continuation line before any field.
+			"123 Fake Header\n continued\n\n",
+		},
+	}
+
+	for idx, tt := range tests {
+		var buffer bytes.Buffer
+		buffer.WriteString(tt.msg)
+		reader := NewAptMessageReader(bufio.NewReader(&buffer))
+		if _, err := reader.ReadMessage(context.Background()); err == nil {
+			t.Errorf("validation failed test %d", idx)
+		}
+	}
+}
+
+func TestAptReaderReadMessageCancel(t *testing.T) {
+	pipereader, pipewriter := io.Pipe()
+	defer pipewriter.Close()
+	reader := NewAptMessageReader(bufio.NewReader(pipereader))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error)
+	go func() {
+		_, err := reader.ReadMessage(ctx)
+		errChan <- err
+	}()
+	cancel()
+	if err := <-errChan; !errors.Is(err, context.Canceled) {
+		t.Fatalf("failed, expected context.Canceled, got %v", err)
+	}
+
+	// Input arriving later is still read by the next call.
+	go io.WriteString(pipewriter, "101 Log\nMessage: after cancel\n\n")
+	msg, err := reader.ReadMessage(context.Background())
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if msg.Get("Message") != "after cancel" {
+		t.Errorf("failed, expected: %q got: %q", "after cancel", msg.Get("Message"))
+	}
+}
+
+func TestAptReaderReadMessageLimits(t *testing.T) {
+	limits := ReaderLimits{MaxLineLength: 32, MaxFields: 2, MaxMessageSize: 64}
+	var tests = []struct {
+		msg      string
+		expected error
+	}{
+		{
+			"101 Log\nMessage: " + strings.Repeat("x", 32) + "\nOther: field\n\n",
+			ErrLineTooLong,
+		},
+		{
+			"101 Log\nA: 1\nB: 2\nC: 3\n\n",
+			ErrTooManyFields,
+		},
+		{
+			"101 Log\nMessage: first\n second line here\n third line here\n fourth line\n\n",
+			ErrMessageTooLarge,
+		},
+		{
+			"101 Log\n: no key\nMessage: ignored\n\n",
+			nil,
+		},
+	}
+
+	for idx, tt := range tests {
+		var buffer bytes.Buffer
+		buffer.WriteString(tt.msg)
+		buffer.WriteString("102 Status\nMessage: next\n\n")
+		reader := NewAptMessageReader(bufio.NewReader(&buffer))
+		reader.SetLimits(limits)
+
+		_, err := reader.ReadMessage(context.Background())
+		if err == nil || (tt.expected != nil && !errors.Is(err, tt.expected)) {
+			t.Errorf("test %d failed, expected: %v got: %v", idx, tt.expected, err)
+		}
+		var limitErr *LimitError
+		if isLimit := errors.As(err, &limitErr); isLimit != (tt.expected != nil) {
+			t.Errorf("test %d failed, %v is a *LimitError: %v", idx, err, isLimit)
+		}
+
+		// The rest of the bad message is skipped.
+		msg, err := reader.ReadMessage(context.Background())
+		if err != nil {
+			t.Fatalf("test %d failed, %v", idx, err)
+		}
+		if msg.code != 102 || msg.Get("Message") != "next" {
+			t.Errorf("test %d failed, expected next message, got %q", idx, msg)
+		}
+	}
+}
+
+func TestAptFoldRoundTrip(t *testing.T) {
+	var tests = []string{
+		"single line",
+		"two\nlines",
+		"blank\n\nline",
+		"crlf\r\nline",
+		"  indented\n\tcontinuation",
+	}
+
+	for _, val := range tests {
+		var buffer bytes.Buffer
+		writer := NewAptMessageWriter(&buffer)
+		writer.Log(val)
+		reader := NewAptMessageReader(bufio.NewReader(&buffer))
+		msg, err := reader.ReadMessage(context.Background())
+		if err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+		expected := strings.TrimSpace(strings.ReplaceAll(val, "\r\n", "\n"))
+		if res := msg.Get("Message"); res != expected {
+			t.Errorf("failed, expected: %q got: %q", expected, res)
+		}
+	}
+}
+
 func TestAptReaderParseHeader(t *testing.T) {
 	var tests = []struct {
 		message  Message
@@ -368,19 +604,25 @@ func TestAptReaderParseField(t *testing.T) {
 	var tests = []struct {
 		message  Message
 		field    string
-		expected map[string][]string
+		expected []field
 	}{
 		{
 			// Test initial fields.
 			Message{},
 			"Field1: val1",
-			map[string][]string{"Field1": {"val1"}},
+			[]field{{"Field1", "val1"}},
 		},
 		{
 			// Test appending fields.
-			Message{fields: map[string][]string{"Field1": {"val1"}}},
+			Message{fields: []field{{"Field1", "val1"}}},
 			"Field1: val2",
-			map[string][]string{"Field1": {"val1", "val2"}},
+			[]field{{"Field1", "val1"}, {"Field1", "val2"}},
+		},
+		{
+			// Test known fields are canonicalized.
+			Message{fields: []field{{"Field1", "val1"}}},
+			"uri: val2",
+			[]field{{"Field1", "val1"}, {"URI", "val2"}},
 		},
 	}
 
@@ -15,12 +15,22 @@
 package apt
 
 import (
+	"fmt"
 	"io"
+	"strconv"
+	"sync"
 )
 
-// MessageWriter supports writing Apt messages.
+// MessageWriter supports writing Apt messages. It is safe for concurrent
+// use; each message is formatted in memory and written whole, with a single
+// call to the underlying writer. After a write fails, nothing more is written
+// and every call returns the same error.
 type MessageWriter struct {
+	mu     sync.Mutex
 	writer io.Writer
+	err    error
+	// done is closed when err is set.
+	done chan struct{}
 }
 
 // NewAptMessageWriter returns an AptMessageWriter.
@@ -35,38 +45,86 @@ func (w *MessageWriter) WriteMessage(m Message) error {
 
 // WriteString writes a raw string.
 func (w *MessageWriter) writeString(s string) error {
-	if _, err := w.writer.Write([]byte(s)); err != nil {
-		return err
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if _, err := io.WriteString(w.writer, s); err != nil {
+		w.err = fmt.Errorf("writing to apt: %w", err)
+		close(w.doneChan())
+		return w.err
 	}
 	return nil
 }
 
+// Err returns the error which stopped the writer, if any.
+func (w *MessageWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Done returns a channel which is closed when a write fails.
+func (w *MessageWriter) Done() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.doneChan()
+}
+
+// doneChan must be called with mu held.
+func (w *MessageWriter) doneChan() chan struct{} {
+	if w.done == nil {
+		w.done = make(chan struct{})
+	}
+	return w.done
+}
+
+// Send writes a typed message.
+func (w *MessageWriter) Send(v TypedMessage) error {
+	return w.WriteMessage(*Marshal(v))
+}
+
 // SendCapabilities writes a 100 Capabilities message.
+//
+// Deprecated: Use Send with a Capabilities.
 func (w *MessageWriter) SendCapabilities() error {
-	return w.WriteMessage(new100Message())
+	return w.Send(Capabilities{Version: "1.0", SendConfig: true})
 }
 
 // Log writes a 101 Log message.
 func (w *MessageWriter) Log(msg string) error {
-	return w.WriteMessage(new101Message(msg))
+	return w.Send(Log{Message: msg})
 }
 
 // URIStart writes a 200 URI Start message.
+//
+// Deprecated: Use Send with a URIStart.
 func (w *MessageWriter) URIStart(uri, size, lastModified string) error {
-	return w.WriteMessage(new200Message(uri, size, lastModified))
+	n, _ := strconv.ParseInt(size, 10, 64)
+	return w.Send(URIStart{URI: uri, Size: n, LastModified: lastModified})
 }
 
 // URIDone writes a 201 URI Done message.
+//
+// Deprecated: Use Send with a URIDone.
 func (w *MessageWriter) URIDone(uri, size, lastModified, md5Hash, filename string, ims bool) error {
-	return w.WriteMessage(new201Message(uri, size, lastModified, md5Hash, filename, ims))
+	done := URIDone{URI: uri, Filename: filename, LastModified: lastModified, IMSHit: ims}
+	if !ims {
+		done.Size, _ = strconv.ParseInt(size, 10, 64)
+		done.MD5Hash = md5Hash
+	}
+	return w.Send(done)
 }
 
 // FailURI writes a 400 URI Failure message.
+//
+// Deprecated: Use Send with a URIFailure.
 func (w *MessageWriter) FailURI(uri, msg string) error {
-	return w.WriteMessage(new400Message(uri, msg))
+	return w.Send(URIFailure{URI: uri, Message: msg})
 }
 
 // Fail writes a 401 General Failure message.
 func (w *MessageWriter) Fail(msg string) error {
-	return w.WriteMessage(new401Message(msg))
+	return w.Send(GeneralFailure{Message: msg})
 }
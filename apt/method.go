@@ -18,15 +18,27 @@ import (
 	"bufio"
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
-	"net/http/httputil"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"cloud.google.com/go/compute/metadata"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
@@ -37,12 +49,18 @@ const (
 
 // NewAptMethod returns an AptMethod.
 func NewAptMethod(input *bufio.Reader, output io.Writer) *Method {
-	return &Method{
+	m := &Method{
 		config: &aptMethodConfig{},
-		writer: NewAptMessageWriter(output),
-		reader: NewAptMessageReader(input),
 		dl:     downloaderImpl{},
 	}
+	m.newClient = m.buildClient
+	m.server = NewServer(m, input, output,
+		WithSendConfig(true),
+		WithSendURIEncoded(true),
+		WithStackTraces(func() bool { return m.config.debugLevel > 0 }),
+		WithStart(m.start))
+	m.writer = m.server.Writer()
+	return m
 }
 
 // httpClient exists to enable mocking of http.Client.
@@ -52,179 +70,798 @@ type httpClient interface {
 
 // downloader exists to enable mocking of AptMethod.download.
 type downloader interface {
-	download(io.ReadCloser, string) (string, error)
+	download(io.ReadCloser, string) (fileHashes, error)
+}
+
+// fileHashes holds the digests and size of a downloaded file.
+type fileHashes struct {
+	md5, sha256 string
+	size        int64
 }
 
 type downloaderImpl struct{}
 
-// Method represents the method handler.
+// Method is the Handler for Artifact Registry. It is not safe for concurrent
+// use, so its Server handles one acquire at a time.
 type Method struct {
-	reader *MessageReader
+	server *Server
+	// writer is the Server's writer, which is also passed to each Handler
+	// call.
 	writer *MessageWriter
-	config *aptMethodConfig
-	client httpClient
+	// config is rebuilt from configItems, the merged contents of every 601
+	// Configuration received, whenever another arrives. Those take
+	// precedence over baseItems, from the config file and environment.
+	config      *aptMethodConfig
+	configItems []configItem
+	baseItems   []configItem
+	baseErrs    []error
+	// client is used for hosts without overrides, and hostClients for the
+	// others.
+	client      httpClient
+	hostClients map[string]httpClient
+	// newClient builds a client for `config`.
+	newClient func(ctx context.Context, config *aptMethodConfig) (httpClient, error)
+	// tokens is shared by all clients.
+	tokens oauth2.TokenSource
 	dl     downloader
+	// unhealthy records mirror hosts which have failed during this session.
+	unhealthy map[string]bool
+	// logger writes to logFile, opened for the configured Log-File and
+	// logFormat, or to apt if there is none.
+	logger    *slog.Logger
+	logFile   *os.File
+	logFormat string
+	// principal identifies the credentials tokens are fetched for.
+	principal string
+	metrics   *metrics
+	// tracer is nil unless tracing to traceEndpoint.
+	tracer        *tracer
+	traceEndpoint string
 }
 
 type aptMethodConfig struct {
 	serviceAccountJSON, serviceAccountEmail string
-	debug                                   bool
+	// debugLevel is from 0, for none, to debugWire.
+	debugLevel         int
+	logFile, logFormat string
+	metricsFile        string
+	// traceEndpoint is an OTLP/HTTP collector's traces URL.
+	traceEndpoint string
+	// auditLog is a file recording every file fetched.
+	auditLog             string
+	redirectForeignHosts bool
+	// mirrors maps a repository prefix ("host/path") to its alternates.
+	mirrors map[string][]string
+	// timeout bounds connecting and waiting for response headers.
+	timeout time.Duration
+	// retries is the number of extra attempts made at every candidate URL
+	// after they have all failed.
+	retries int
+	// proxy is a proxy URL, or "DIRECT" to ignore the environment.
+	proxy string
+	// caInfo is a file of PEM certificates to trust instead of the system's.
+	caInfo string
+	// hosts holds the overrides of the settings above for each host, as
+	// items of hostOptions.
+	hosts        map[string][]field
+	cacheDir     string
+	cacheMaxSize int64
+	stateDir     string
+	forceIPv4    bool
+	forceIPv6    bool
 }
 
-// Run runs the method.
+// Run runs the method, configured by the config file and environment until
+// apt sends its configuration.
 func (m *Method) Run(ctx context.Context) error {
-	m.writer.SendCapabilities()
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-		}
-		msg, err := m.reader.ReadMessage(ctx)
-		if errors.Is(err, errEmptyMessage) {
-			continue
-		} else if errors.Is(err, io.EOF) {
-			return nil
-		} else if err != nil {
-			return err
-		}
-		switch msg.code {
-		case 600:
-			m.handleAcquire(ctx, msg)
-		case 601:
-			m.handleConfigure(msg)
-		default:
-			// TODO(hopkiw): now write a test for this.
-			m.writer.Fail(fmt.Sprintf("Unsupported message code %d received from apt", msg.code))
+	m.loadBaseConfig(os.Environ())
+	if err := m.openLog(); err != nil {
+		m.baseErrs = append(m.baseErrs, err)
+	}
+	if err := m.openTracer(); err != nil {
+		m.baseErrs = append(m.baseErrs, err)
+	}
+	defer m.closeLog()
+	err := m.server.Serve(ctx)
+	// ctx may have been cancelled, but the spans of an interrupted session
+	// are still wanted.
+	if err := m.tracer.flush(context.Background()); err != nil {
+		m.log().Error(err.Error())
+	}
+	if err := m.writeMetrics(); err != nil {
+		m.log().Error(err.Error())
+	}
+	return err
+}
+
+// loadBaseConfig configures the method from the config file and `environ`,
+// the environment. Any problems are kept in baseErrs for start to report.
+func (m *Method) loadBaseConfig(environ []string) {
+	m.baseItems, m.baseErrs = loadConfigSources(environ)
+	var errs []error
+	m.config, errs = buildConfig(m.baseItems)
+	m.baseErrs = append(m.baseErrs, errs...)
+}
+
+// start reports problems setting up from the config file and environment,
+// and describes the configuration in debug mode, as soon as apt has the
+// method's capabilities and can be sent log messages.
+func (m *Method) start(w *MessageWriter) {
+	for _, err := range m.baseErrs {
+		w.Log(err.Error())
+	}
+	m.baseErrs = nil
+	if m.config.debugLevel > 0 {
+		w.Log(describeConfig(m.baseItems))
+	}
+}
+
+// Configure implements Handler.
+func (m *Method) Configure(ctx context.Context, w *MessageWriter, config *Configuration) error {
+	m.handleConfigure(config)
+	return nil
+}
+
+// Acquire implements Handler.
+func (m *Method) Acquire(ctx context.Context, w *MessageWriter, req *URIAcquire) error {
+	return m.handleAcquire(ctx, req)
+}
+
+// initClient returns the client for requests to `host`, building it unless
+// there is one for the current configuration.
+func (m *Method) initClient(ctx context.Context, host string) (httpClient, error) {
+	host = strings.ToLower(host)
+	if len(m.config.hosts[host]) == 0 {
+		if m.client == nil {
+			client, err := m.newClient(ctx, m.config)
+			if err != nil {
+				return nil, err
+			}
+			m.client = client
 		}
+		return m.client, nil
+	}
+	if client, ok := m.hostClients[host]; ok {
+		return client, nil
 	}
+	client, err := m.newClient(ctx, m.config.forHost(host))
+	if err != nil {
+		return nil, err
+	}
+	if m.hostClients == nil {
+		m.hostClients = make(map[string]httpClient)
+	}
+	m.hostClients[host] = client
+	return client, nil
 }
 
-func (m *Method) initClient(ctx context.Context) error {
-	if m.client != nil {
-		return nil
+// buildClient returns an HTTP client for `config`, authenticating with the
+// configured credentials.
+func (m *Method) buildClient(ctx context.Context, config *aptMethodConfig) (httpClient, error) {
+	if m.tokens == nil {
+		ts, err := m.tokenSource(ctx)
+		if err != nil {
+			return nil, err
+		}
+		m.tokens = oauth2.ReuseTokenSource(nil, timedTokenSource{ts, m.stats().tokenLatency})
 	}
+	transport, err := m.newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &oauth2.Transport{
+			Source: m.tokens,
+			Base:   debugTransport{m, transport},
+		},
+		CheckRedirect: m.checkRedirect,
+	}, nil
+}
 
+// tokenSource returns a source of tokens for the configured credentials.
+func (m *Method) tokenSource(ctx context.Context) (oauth2.TokenSource, error) {
 	var ts oauth2.TokenSource
 	switch {
 	case m.config.serviceAccountJSON != "":
 		json, err := os.ReadFile(m.config.serviceAccountJSON)
 		if err != nil {
-			return fmt.Errorf("failed to read service account JSON file: %v", err)
+			return nil, fmt.Errorf("failed to read service account JSON file: %v", err)
 		}
 		creds, err := google.CredentialsFromJSON(ctx, json, cloudPlatformScope)
 		if err != nil {
-			return fmt.Errorf("failed to obtain creds from service account JSON: %v", err)
+			return nil, fmt.Errorf("failed to obtain creds from service account JSON: %v", err)
 		}
 		ts = creds.TokenSource
+		m.principal = credentialsPrincipal(creds, m.config.recordsPrincipal())
 	case m.config.serviceAccountEmail != "":
 		ts = google.ComputeTokenSource(m.config.serviceAccountEmail)
+		m.principal = m.config.serviceAccountEmail
 	default:
 		creds, err := google.FindDefaultCredentials(ctx, cloudPlatformScope)
 		if err != nil {
-			return fmt.Errorf("failed to obtain default creds: %v", err)
+			return nil, fmt.Errorf("failed to obtain default creds: %v", err)
 		}
 		ts = creds.TokenSource
+		m.principal = credentialsPrincipal(creds, m.config.recordsPrincipal())
 	}
 	if ts == nil {
-		return errors.New("failed to obtain creds")
+		return nil, errors.New("failed to obtain creds")
+	}
+	return ts, nil
+}
+
+// credentialsPrincipal returns the identity `creds` authenticate as: the
+// service account, including one impersonated by workload identity
+// federation, or else the federated subject. Without a credentials file, the
+// metadata server's default service account is asked for if `askMetadata`.
+// It returns "default" if the identity can't be found.
+func credentialsPrincipal(creds *google.Credentials, askMetadata bool) string {
+	if len(creds.JSON) == 0 {
+		if !askMetadata {
+			return "default"
+		}
+		if email, err := metadata.Email("default"); err == nil && email != "" {
+			return email
+		}
+		return "default"
+	}
+	var f struct {
+		Type                           string `json:"type"`
+		ClientEmail                    string `json:"client_email"`
+		ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+		CredentialSource               struct {
+			File string `json:"file"`
+		} `json:"credential_source"`
+	}
+	if json.Unmarshal(creds.JSON, &f) != nil {
+		return "default"
+	}
+	switch {
+	case f.ClientEmail != "":
+		return f.ClientEmail
+	case f.ServiceAccountImpersonationURL != "":
+		// https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/<email>:generateAccessToken
+		_, account, _ := strings.Cut(f.ServiceAccountImpersonationURL, "/serviceAccounts/")
+		if email, _, ok := strings.Cut(account, ":"); ok && email != "" {
+			return email
+		}
+	case f.Type == "external_account":
+		if subject := tokenSubject(f.CredentialSource.File); subject != "" {
+			return subject
+		}
+	}
+	return "default"
+}
+
+// tokenSubject returns the subject of the JWT in the file at `path`, such as
+// the subject token of a federated identity, or "" if there is none.
+func tokenSubject(path string) string {
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(string(data)), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if json.Unmarshal(payload, &claims) != nil {
+		return ""
+	}
+	return claims.Subject
+}
+
+// newTransport returns the transport underlying the authenticated client. A
+// method process handles every file apt fetches from our sources, mostly
+// small index files from a handful of hosts, so we keep connections around
+// for reuse rather than relying on http.DefaultTransport.
+func (m *Method) newTransport(config *aptMethodConfig) (*http.Transport, error) {
+	dialTimeout := 30 * time.Second
+	if config.timeout > 0 {
+		dialTimeout = config.timeout
+	}
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	network := "tcp"
+	switch {
+	case config.forceIPv4:
+		network = "tcp4"
+	case config.forceIPv6:
+		network = "tcp6"
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          32,
+		MaxIdleConnsPerHost:   8,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: config.timeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	switch config.proxy {
+	case "":
+	case "DIRECT":
+		transport.Proxy = nil
+	default:
+		proxy, err := url.Parse(config.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %v", config.proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if config.caInfo != "" {
+		pem, err := os.ReadFile(config.caInfo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CaInfo: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CaInfo %s", config.caInfo)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return transport, nil
+}
+
+// checkRedirect stops the client from following redirects which leave the
+// original scheme and host when Redirect-Foreign-Hosts is set, so that they
+// can be handed back to apt, which also keeps our credentials from being sent
+// to other hosts. Otherwise every redirect is followed, and the oauth2
+// transport attaches the token to each request, whatever its host.
+func (m *Method) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if !m.config.redirectForeignHosts {
+		return nil
+	}
+	orig := via[0].URL
+	if req.URL.Scheme != orig.Scheme || req.URL.Host != orig.Host {
+		return http.ErrUseLastResponse
 	}
-	m.client = oauth2.NewClient(ctx, ts)
 	return nil
 }
 
 // download performs the actual downloading to target file and returns
-// an MD5 hash of the downloaded file.
-func (r downloaderImpl) download(body io.ReadCloser, filename string) (string, error) {
+// the hashes of the downloaded file. The body is written to a temporary file
+// which only replaces `filename` once complete, so an interrupted download
+// leaves nothing behind.
+func (r downloaderImpl) download(body io.ReadCloser, filename string) (fileHashes, error) {
 	defer body.Close()
-	data, err := io.ReadAll(body)
+	file, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp-*")
 	if err != nil {
-		return "", err
+		return fileHashes{}, err
+	}
+	defer os.Remove(file.Name())
+	hashes, err := copyAndHash(file, body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
 	}
-	file, err := os.Create(filename)
 	if err != nil {
-		return "", err
+		return fileHashes{}, err
 	}
-	defer file.Close()
-
-	_, err = file.Write(data)
-	return fmt.Sprintf("%x", md5.Sum(data)), err
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return fileHashes{}, err
+	}
+	return hashes, os.Rename(file.Name(), filename)
 }
 
-func (m *Method) handleAcquire(ctx context.Context, msg *Message) error {
-	uri := msg.Get("URI")
-	if uri == "" {
-		err := errors.New("no URI provided in Acquire message")
-		m.writer.Fail(err.Error())
-		return err
-	}
-	filename := msg.Get("Filename")
-	if filename == "" {
-		err := errors.New("no filename provided in Acquire message")
-		m.writer.FailURI(uri, err.Error())
-		return err
+// hashFile returns the hashes of an existing file.
+func hashFile(filename string) (fileHashes, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fileHashes{}, err
 	}
-	ifModifiedSince := msg.Get("Last-Modified")
+	defer file.Close()
+	return copyAndHash(io.Discard, file)
+}
 
-	if err := m.initClient(ctx); err != nil {
-		m.writer.FailURI(uri, err.Error())
-		return err
+func copyAndHash(w io.Writer, r io.Reader) (fileHashes, error) {
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, md5Hash, sha256Hash), r)
+	if err != nil {
+		return fileHashes{}, err
 	}
+	return fileHashes{
+		md5:    fmt.Sprintf("%x", md5Hash.Sum(nil)),
+		sha256: fmt.Sprintf("%x", sha256Hash.Sum(nil)),
+		size:   size,
+	}, nil
+}
 
-	realuri := strings.Replace(uri, "ar+https", "https", 1)
-	req, err := http.NewRequest("GET", realuri, nil)
+// fetchFromCache serves an acquire from the download cache, if the file with
+// the expected SHA256 digest is present. It returns false if the file must be
+// fetched from the network, or an error if the result can't be sent to apt.
+func (m *Method) fetchFromCache(req *URIAcquire, rec *acquireRecord) (bool, error) {
+	cache := m.blobCache()
+	if cache == nil || req.ExpectedSHA256 == "" {
+		return false, nil
+	}
+	hit, err := cache.fetch(req.ExpectedSHA256, req.Filename)
 	if err != nil {
-		return err
+		m.writer.Log(fmt.Sprintf("download cache lookup failed: %v", err))
+		return false, nil
 	}
-	if ifModifiedSince != "" {
-		// TODO(hopkiw): validate this string is in RFC1123Z format.
-		req.Header.Add("If-Modified-Since", ifModifiedSince)
+	if !hit {
+		return false, nil
 	}
+	hashes, err := hashFile(req.Filename)
+	if err != nil || !strings.EqualFold(hashes.sha256, req.ExpectedSHA256) {
+		// A corrupt blob must not be served again.
+		m.writer.Log(fmt.Sprintf("discarding corrupt download cache entry %s", req.ExpectedSHA256))
+		cache.remove(req.ExpectedSHA256)
+		return false, nil
+	}
+	rec.cacheHit, rec.bytes, rec.sha256 = true, hashes.size, hashes.sha256
+	if err := m.writer.Send(URIStart{URI: req.URI, Size: hashes.size}); err != nil {
+		return true, err
+	}
+	return true, m.writer.Send(URIDone{
+		URI:        req.URI,
+		Filename:   req.Filename,
+		Size:       hashes.size,
+		MD5Hash:    hashes.md5,
+		SHA256Hash: hashes.sha256,
+	})
+}
 
-	if m.config.debug {
-		if reqDump, dumpErr := httputil.DumpRequest(req, true); dumpErr == nil {
-			m.writer.Log(string(reqDump))
-		}
+// storeInCache adds a completed download to the download cache, provided it
+// matches the digest apt expects.
+func (m *Method) storeInCache(filename, expectedSHA256 string, hashes fileHashes) {
+	cache := m.blobCache()
+	if cache == nil || expectedSHA256 == "" || !strings.EqualFold(hashes.sha256, expectedSHA256) {
+		return
 	}
+	if err := cache.insert(filename, hashes.sha256); err != nil {
+		m.writer.Log(fmt.Sprintf("failed to add %s to download cache: %v", filename, err))
+	}
+}
 
-	resp, err := m.client.Do(req)
+func (m *Method) blobCache() *blobCache {
+	if m.config.cacheDir == "" {
+		return nil
+	}
+	return newBlobCache(m.config.cacheDir, m.config.cacheMaxSize)
+}
 
-	if m.config.debug && resp != nil {
-		if respDump, dumpErr := httputil.DumpResponse(resp, false); dumpErr == nil {
-			m.writer.Log(string(respDump))
+func (m *Method) handleAcquire(ctx context.Context, req *URIAcquire) (err error) {
+	config := m.config
+	rec := &acquireRecord{start: time.Now()}
+	ctx, span := m.tracer.start(ctx, "acquire", spanKindInternal, slog.String("uri", req.URI))
+	defer func() {
+		// A panic fails the acquire once the Server recovers it, so it is
+		// recorded as a failure before being passed on.
+		p := recover()
+		if p != nil {
+			err = fmt.Errorf("internal error: %v", p)
+			defer panic(p)
+		}
+		// Without a Log-File, the timing is in the record logAcquire sends
+		// to apt.
+		if rec.timing != nil && rec.status != 0 && m.logFile != nil {
+			m.writer.Log(fmt.Sprintf("timing %s: %s", req.URI, rec.timing))
 		}
+		m.logAcquire(ctx, config, req.URI, rec, err)
+		m.stats().countAcquire(rec, err)
+		if err == nil {
+			if auditErr := m.writeAudit(req.URI, rec); auditErr != nil {
+				m.writer.Log(auditErr.Error())
+			}
+		}
+		span.setAttrs(slog.Int("status", rec.status), slog.Int64("bytes", rec.bytes), slog.Int("retries", rec.retries), slog.Bool("cache_hit", rec.cacheHit))
+		span.finish(err)
+		// The spans are exported even if the session is being interrupted.
+		if flushErr := m.tracer.flushBatch(context.WithoutCancel(ctx)); flushErr != nil {
+			m.log().Error(flushErr.Error())
+		}
+	}()
+
+	if hit, err := m.fetchFromCache(req, rec); hit || err != nil {
+		return err
 	}
 
+	realurl, err := requestURL(req.URI)
 	if err != nil {
-		m.writer.FailURI(uri, err.Error())
 		return err
 	}
-
-	size := resp.Header.Get("Content-Length")
+	realuri := realurl.String()
+	config = m.config.forHost(realurl.Hostname())
+	// Each candidate gets the client for its host, but they share the
+	// credentials, which the first client sets up.
+	if _, err := m.initClient(ctx, realurl.Hostname()); err != nil {
+		return err
+	}
+	if config.debugLevel > 0 {
+		rec.timing = &requestTiming{}
+		ctx = httptrace.WithClientTrace(ctx, rec.timing.clientTrace())
+	}
+	m.traceCredentials(ctx)
+	header := m.conditionalHeaders(req.URI, req.LastModified)
+	resp, err := m.fetch(ctx, config, m.mirrorCandidates(realuri), header, rec)
+	if err != nil {
+		return err
+	}
+	defer discardBody(resp)
+	rec.status = resp.StatusCode
+	if resp.Request != nil {
+		rec.host = resp.Request.URL.Host
+	}
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
 	lastModified := resp.Header.Get("Last-Modified")
 	switch resp.StatusCode {
 	case 200:
 		// It's weird to send URI Start after we've already contacted
 		// the server, but we need to know the size.
-		m.writer.URIStart(uri, size, lastModified)
-		md5Hash, err := m.dl.download(resp.Body, filename)
+		if err := m.writer.Send(URIStart{URI: req.URI, Size: size, LastModified: lastModified}); err != nil {
+			return err
+		}
+		_, transfer := m.tracer.start(ctx, "transfer", spanKindInternal)
+		transferStart := time.Now()
+		hashes, err := m.dl.download(resp.Body, req.Filename)
+		if rec.timing != nil {
+			rec.timing.transfer = time.Since(transferStart)
+		}
+		rec.sha256 = hashes.sha256
+		transfer.setAttrs(slog.Int64("bytes", hashes.size))
+		transfer.finish(err)
 		if err != nil {
-			m.writer.FailURI(uri, err.Error())
 			return err
 		}
-		m.writer.URIDone(uri, size, lastModified, md5Hash, filename, false)
+		rec.bytes = hashes.size
+		m.storeInCache(req.Filename, req.ExpectedSHA256, hashes)
+		if req.IndexFile {
+			// Only index files are ever re-requested conditionally, so
+			// there's no point keeping ETags for packages.
+			m.recordETag(req.URI, resp)
+		}
+		return m.writer.Send(URIDone{
+			URI:          req.URI,
+			Filename:     req.Filename,
+			LastModified: lastModified,
+			Size:         hashes.size,
+			MD5Hash:      hashes.md5,
+			SHA256Hash:   hashes.sha256,
+		})
 	case 304:
-		// Unchanged since Last-Modified. Respond with "IMS-Hit: true" to
-		// indicate the existing file is valid.
-		m.writer.URIDone(uri, size, lastModified, "", filename, true)
+		// Unchanged since Last-Modified, or matching the ETag. Respond
+		// with "IMS-Hit: true" to indicate the existing file is valid.
+		if config.auditLog != "" {
+			// Record what apt is keeping.
+			if hashes, err := hashFile(req.Filename); err == nil {
+				rec.bytes, rec.sha256 = hashes.size, hashes.sha256
+			}
+		}
+		return m.writer.Send(URIDone{URI: req.URI, Filename: req.Filename, LastModified: lastModified, IMSHit: true})
+	case 301, 302, 303, 307, 308:
+		// We only see redirects here when checkRedirect declined to follow
+		// them. Hand the new location back to apt, which will dispatch it to
+		// the appropriate method.
+		location, err := resp.Location()
+		if err != nil || !m.config.redirectForeignHosts {
+			return fmt.Errorf("error downloading: code %v", resp.StatusCode)
+		}
+		return m.writer.Send(Redirect{URI: req.URI, NewURI: location.String()})
 	default:
 		// All other codes including 404, 403, etc.
-		err := fmt.Errorf("error downloading: code %v", resp.StatusCode)
-		m.writer.FailURI(uri, err.Error())
-		return err
+		return fmt.Errorf("error downloading: code %v", resp.StatusCode)
 	}
+}
 
-	return nil
+// requestURL converts a URI from apt into the URL to request, replacing the
+// ar+https scheme with https. apt percent-encodes URIs when we advertise
+// Send-URI-Encoded, but older versions send them as-is, so both forms are
+// accepted. The path is re-encoded so that characters common in package
+// filenames are sent unambiguously: "+" as %2B, and "~" literally.
+func requestURL(uri string) (*url.URL, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		// Not valid as an encoded URI, for example due to a literal "%",
+		// so it must be a raw one.
+		scheme, rest, ok := strings.Cut(uri, "://")
+		if !ok {
+			return nil, fmt.Errorf("malformed URI %q", uri)
+		}
+		host, path, _ := strings.Cut(rest, "/")
+		u = &url.URL{Scheme: scheme, Host: host, Path: "/" + path}
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("malformed URI %q, no host", uri)
+	}
+	if u.Scheme == "ar+https" {
+		u.Scheme = "https"
+	}
+
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(url.PathEscape(segment), "+", "%2B")
+	}
+	u.RawPath = strings.Join(segments, "/")
+	return u, nil
+}
+
+// retryDelay is the wait before the first retry of a failed fetch, doubling
+// for each further retry up to maxRetryDelay.
+var retryDelay = time.Second
+
+const maxRetryDelay = 30 * time.Second
+
+// retryWait returns the wait before retry number `attempt`, counting from 0.
+func retryWait(attempt int) time.Duration {
+	delay := retryDelay
+	for i := 0; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// fetch requests each candidate URL in turn until one responds without a
+// connection error or server error, using the client and settings for the
+// candidate's host. Hosts which fail are marked unhealthy for the rest of the
+// session. If every candidate fails, they are all tried again up to
+// config.retries times, `config` being the settings for the requested URI,
+// and then the last response or error is returned. The retries are counted in
+// `rec`.
+func (m *Method) fetch(ctx context.Context, config *aptMethodConfig, candidates []string, header http.Header, rec *acquireRecord) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		resp, err = m.fetchCandidates(ctx, candidates, header)
+		if err == nil && resp.StatusCode < 500 || attempt >= config.retries {
+			return resp, err
+		}
+		rec.retries++
+		delay := retryWait(attempt)
+		if err != nil {
+			m.writer.Log(fmt.Sprintf("fetch failed, retrying in %v: %v", delay, err))
+		} else {
+			m.writer.Log(fmt.Sprintf("fetch failed, retrying in %v: code %v", delay, resp.StatusCode))
+			discardBody(resp)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// fetchCandidates makes one attempt at each candidate, as described by fetch.
+func (m *Method) fetchCandidates(ctx context.Context, candidates []string, header http.Header) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	for i, candidate := range candidates {
+		reqCtx, span := m.tracer.start(ctx, "GET", spanKindClient, slog.String("url.full", candidate))
+		var req *http.Request
+		req, err = http.NewRequestWithContext(reqCtx, "GET", candidate, nil)
+		if err != nil {
+			span.finish(err)
+			return nil, err
+		}
+		config := m.config.forHost(req.URL.Hostname())
+		var client httpClient
+		client, err = m.initClient(ctx, req.URL.Hostname())
+		if err != nil {
+			span.finish(err)
+			return nil, err
+		}
+		req.Header = header.Clone()
+		injectTraceHeaders(reqCtx, req.Header)
+		if m.tracer != nil {
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), m.tracer.connectionTrace(reqCtx)))
+		}
+		if config.logs(levelWire) {
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), m.connTrace()))
+		}
+		m.logRequest(ctx, config, req)
+
+		resp, err = client.Do(req)
+		// The error may hold a signed URL we were redirected to, so only
+		// the redacted form is passed on, to be logged and sent to apt.
+		err = redactError(err)
+		m.stats().countRequest(req.URL.Host, resp, err)
+		if err == nil {
+			span.setAttrs(slog.Int("http.response.status_code", resp.StatusCode))
+			if resp.StatusCode >= 500 {
+				span.finish(fmt.Errorf("code %v", resp.StatusCode))
+			} else {
+				span.finish(nil)
+			}
+		} else {
+			span.finish(err)
+		}
+
+		m.logResponse(ctx, config, req, resp, err)
+
+		if err == nil && resp.StatusCode < 500 {
+			if len(candidates) > 1 {
+				m.writer.Log(fmt.Sprintf("%s served by mirror %s", candidate, req.URL.Host))
+			}
+			return resp, nil
+		}
+		m.markUnhealthy(req.URL.Host)
+		if i < len(candidates)-1 {
+			if err != nil {
+				m.writer.Log(fmt.Sprintf("mirror %s failed, trying next: %v", req.URL.Host, err))
+			} else {
+				m.writer.Log(fmt.Sprintf("mirror %s failed, trying next: code %v", req.URL.Host, resp.StatusCode))
+				discardBody(resp)
+			}
+		}
+	}
+	return resp, err
+}
+
+// traceCredentials records a span for getting a token for the request about
+// to be made. The token is cached, so only the first request, or one made
+// when the token has expired, waits for it.
+func (m *Method) traceCredentials(ctx context.Context) {
+	if m.tracer == nil || m.tokens == nil {
+		return
+	}
+	_, span := m.tracer.start(ctx, "credentials", spanKindInternal)
+	_, err := m.tokens.Token()
+	span.setAttrs(slog.String("principal", m.principal))
+	span.finish(err)
+}
+
+// logRequest logs `req` if config.debugLevel asks for requests. Headers and
+// dumps are logged by debugTransport, which sees what is actually sent.
+func (m *Method) logRequest(ctx context.Context, config *aptMethodConfig, req *http.Request) {
+	if config.logs(levelRequests) {
+		m.log().LogAttrs(ctx, levelRequests, "request", slog.String("method", req.Method), slog.String("url", req.URL.String()))
+	}
+}
+
+// logResponse logs the response to `req`, or the error getting it, if
+// config.debugLevel asks for requests.
+func (m *Method) logResponse(ctx context.Context, config *aptMethodConfig, req *http.Request, resp *http.Response, err error) {
+	if !config.logs(levelRequests) {
+		return
+	}
+	if err != nil {
+		m.log().LogAttrs(ctx, levelRequests, "request failed", slog.String("url", req.URL.String()), slog.String("error", err.Error()))
+		return
+	}
+	m.log().LogAttrs(ctx, levelRequests, "response", slog.String("url", req.URL.String()), slog.Int("status", resp.StatusCode))
+}
+
+// connTrace logs whether each request got a new or reused connection.
+func (m *Method) connTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			remote := slog.String("remote", info.Conn.RemoteAddr().String())
+			if info.Reused {
+				m.log().LogAttrs(context.Background(), levelWire, "reusing connection", remote, slog.Duration("idle", info.IdleTime))
+			} else {
+				m.log().LogAttrs(context.Background(), levelWire, "new connection", remote)
+			}
+		},
+	}
+}
+
+// discardBody drains a little of an unread response body before closing it,
+// so that the connection can be reused.
+func discardBody(resp *http.Response) {
+	if resp.Body == nil {
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
 }
 
 // Ported from apt's `StringToBool` function
@@ -248,29 +885,64 @@ func stringToBool(s string) bool {
 	return false
 }
 
-func (m *Method) handleConfigure(msg *Message) {
-	configs, ok := msg.fields["Config-Item"]
-	if !ok {
-		// Nothing to set.
-		return
-	}
-	for _, configItem := range configs {
-		parts := strings.SplitN(configItem, "=", 2)
-		if len(parts) != 2 {
-			m.writer.Log(fmt.Sprintf("malformed config item: %v", configItem))
-			return
+// parseSize parses a size in bytes, with an optional K, M, G or T suffix
+// denoting a power of 1024.
+func parseSize(orig string) (int64, error) {
+	s := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(orig)), "B"), "I")
+	var shift uint
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			shift = 10
+		case 'M':
+			shift = 20
+		case 'G':
+			shift = 30
+		case 'T':
+			shift = 40
 		}
-		switch parts[0] {
-		case "Acquire::gar::Service-Account-JSON":
-			m.config.serviceAccountJSON = strings.TrimSpace(parts[1])
-		case "Acquire::gar::Service-Account-Email":
-			m.config.serviceAccountEmail = strings.TrimSpace(parts[1])
-		case "Debug::Acquire::gar":
-			m.config.debug = stringToBool(strings.TrimSpace(parts[1]))
+		if shift != 0 {
+			s = strings.TrimSpace(s[:len(s)-1])
 		}
 	}
-	// Enforce the precedence of these two options.
-	if m.config.serviceAccountJSON != "" {
-		m.config.serviceAccountEmail = ""
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid size %q", orig)
+	}
+	return n << shift, nil
+}
+
+// handleConfigure merges the items of a 601 Configuration into those already
+// received and rebuilds the configuration from them, on top of the config
+// file and environment. Every problem with the configuration is logged, and
+// otherwise ignored.
+func (m *Method) handleConfigure(config *Configuration) {
+	update, errs := parseConfigItems(config.ConfigItems)
+	m.configItems = mergeConfigItems(m.configItems, update)
+
+	previous := m.config
+	items := mergeConfigItems(m.baseItems, m.configItems)
+	m.config, _ = buildConfig(items)
+	// Only the new items are checked, as start has reported any problems with
+	// the others, and earlier calls those with apt's.
+	_, configErrs := buildConfig(update)
+	if err := m.openLog(); err != nil {
+		configErrs = append(configErrs, err)
+	}
+	if err := m.openTracer(); err != nil {
+		configErrs = append(configErrs, err)
+	}
+	for _, err := range append(errs, configErrs...) {
+		m.writer.Log(err.Error())
+	}
+	if m.config.debugLevel > 0 {
+		m.writer.Log(describeConfig(items))
+	}
+	if !previous.sameClient(m.config) {
+		// Built from the old settings; initClient makes new ones.
+		if m.config.debugLevel > 0 && m.client != nil {
+			m.writer.Log("client configuration changed, rebuilding HTTP client")
+		}
+		m.client, m.hostClients, m.tokens = nil, nil, nil
 	}
 }
@@ -16,11 +16,21 @@ package apt
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/pem"
+	"errors"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestHandleConfigure(t *testing.T) {
@@ -51,73 +61,199 @@ func TestHandleConfigure(t *testing.T) {
 			[]string{
 				"Debug::Acquire::gar=1",
 			},
-			aptMethodConfig{debug: true},
+			aptMethodConfig{debugLevel: 1},
 		},
 		{
 			[]string{
 				"Debug::Acquire::gar=enable",
 			},
-			aptMethodConfig{debug: true},
+			aptMethodConfig{debugLevel: 1},
+		},
+		{
+			[]string{
+				"Debug::Acquire::gar=3",
+			},
+			aptMethodConfig{debugLevel: 3},
 		},
 		{
 			[]string{
 				"Debug::Acquire::gar=10",
 			},
-			aptMethodConfig{debug: false},
+			aptMethodConfig{},
 		},
 		{
 			[]string{
 				"Debug::Acquire::gar=0",
 			},
-			aptMethodConfig{debug: false},
+			aptMethodConfig{},
 		},
 		{
 			[]string{
 				"Debug::Acquire::gar=-1",
 			},
-			aptMethodConfig{debug: false},
+			aptMethodConfig{},
+		},
+		{
+			[]string{
+				"Acquire::gar::Redirect-Foreign-Hosts=true",
+			},
+			aptMethodConfig{redirectForeignHosts: true},
+		},
+		{
+			[]string{
+				"Acquire::ForceIPv4=true",
+			},
+			aptMethodConfig{forceIPv4: true},
+		},
+		{
+			[]string{
+				"Acquire::gar::Mirrors::us-apt.pkg.dev/projects/p::=europe-apt.pkg.dev/projects/p",
+			},
+			aptMethodConfig{mirrors: map[string][]string{"us-apt.pkg.dev/projects/p": {"europe-apt.pkg.dev/projects/p"}}},
 		},
 	}
 
 	for _, tt := range tests {
-		method := &Method{config: &aptMethodConfig{}}
-		msg := &Message{
-			code:        601,
-			description: "Configuration",
-			fields:      map[string][]string{"Config-Item": tt.configItems},
-		}
-
-		method.handleConfigure(msg)
+		method := &Method{config: &aptMethodConfig{}, writer: NewAptMessageWriter(io.Discard)}
+		method.handleConfigure(&Configuration{ConfigItems: tt.configItems})
 		if method.config.serviceAccountJSON != tt.expected.serviceAccountJSON {
 			t.Errorf("path config items don't match, got %q expected %q", method.config.serviceAccountJSON, tt.expected.serviceAccountJSON)
 		}
 		if method.config.serviceAccountEmail != tt.expected.serviceAccountEmail {
 			t.Errorf("email config items don't match, got %q expected %q", method.config.serviceAccountEmail, tt.expected.serviceAccountEmail)
 		}
+		if method.config.redirectForeignHosts != tt.expected.redirectForeignHosts {
+			t.Errorf("redirect config items don't match, got %v expected %v", method.config.redirectForeignHosts, tt.expected.redirectForeignHosts)
+		}
+		if method.config.forceIPv4 != tt.expected.forceIPv4 || method.config.forceIPv6 != tt.expected.forceIPv6 {
+			t.Errorf("IP version config items don't match, got %v/%v expected %v/%v", method.config.forceIPv4, method.config.forceIPv6, tt.expected.forceIPv4, tt.expected.forceIPv6)
+		}
+		if !reflect.DeepEqual(method.config.mirrors, tt.expected.mirrors) {
+			t.Errorf("mirror config items don't match, got %v expected %v", method.config.mirrors, tt.expected.mirrors)
+		}
+
+	}
 
+}
+
+func TestHandleConfigureUpdate(t *testing.T) {
+	var tests = []struct {
+		configItems []string
+		rebuilt     bool
+		expected    aptMethodConfig
+	}{
+		{
+			[]string{
+				"Acquire::gar::Service-Account-Email=first@domain",
+				"Acquire::gar::Mirrors::us-apt.pkg.dev/projects/p::=one.pkg.dev/projects/p",
+				"Acquire::gar::Mirrors::us-apt.pkg.dev/projects/p::=two.pkg.dev/projects/p",
+			},
+			true,
+			aptMethodConfig{serviceAccountEmail: "first@domain", mirrors: map[string][]string{
+				"us-apt.pkg.dev/projects/p": {"one.pkg.dev/projects/p", "two.pkg.dev/projects/p"},
+			}},
+		},
+		{
+			// Earlier items are kept, and a list is replaced as a whole.
+			[]string{
+				"Acquire::gar::Redirect-Foreign-Hosts=true",
+				"Acquire::gar::Mirrors::us-apt.pkg.dev/projects/p::=three.pkg.dev/projects/p",
+			},
+			false,
+			aptMethodConfig{serviceAccountEmail: "first@domain", redirectForeignHosts: true, mirrors: map[string][]string{
+				"us-apt.pkg.dev/projects/p": {"three.pkg.dev/projects/p"},
+			}},
+		},
+		{
+			[]string{"Acquire::gar::Service-Account-Email=second@domain"},
+			true,
+			aptMethodConfig{serviceAccountEmail: "second@domain", redirectForeignHosts: true, mirrors: map[string][]string{
+				"us-apt.pkg.dev/projects/p": {"three.pkg.dev/projects/p"},
+			}},
+		},
+		{
+			[]string{"Acquire::gar::Service-Account-JSON=/path/to/creds.json"},
+			true,
+			aptMethodConfig{serviceAccountJSON: "/path/to/creds.json", redirectForeignHosts: true, mirrors: map[string][]string{
+				"us-apt.pkg.dev/projects/p": {"three.pkg.dev/projects/p"},
+			}},
+		},
+		{
+			[]string{"Acquire::gar::Service-Account-JSON=/path/to/creds.json"},
+			false,
+			aptMethodConfig{serviceAccountJSON: "/path/to/creds.json", redirectForeignHosts: true, mirrors: map[string][]string{
+				"us-apt.pkg.dev/projects/p": {"three.pkg.dev/projects/p"},
+			}},
+		},
+		{
+			[]string{"Acquire::ForceIPv6=true"},
+			true,
+			aptMethodConfig{serviceAccountJSON: "/path/to/creds.json", redirectForeignHosts: true, forceIPv6: true, mirrors: map[string][]string{
+				"us-apt.pkg.dev/projects/p": {"three.pkg.dev/projects/p"},
+			}},
+		},
 	}
 
+	var buffer bytes.Buffer
+	method := &Method{config: &aptMethodConfig{}, writer: NewAptMessageWriter(&buffer)}
+	for idx, tt := range tests {
+		method.client = fakeHTTPClient{}
+		method.handleConfigure(&Configuration{ConfigItems: tt.configItems})
+		if rebuilt := method.client == nil; rebuilt != tt.rebuilt {
+			t.Errorf("test %d failed, client dropped: %v expected %v", idx, rebuilt, tt.rebuilt)
+		}
+		if !reflect.DeepEqual(*method.config, tt.expected) {
+			t.Errorf("test %d failed, expected: %+v got: %+v", idx, tt.expected, *method.config)
+		}
+	}
 }
 
+// fakeHTTPClient responds to each request with `code`, `header` and `body`,
+// or fails it with `err`.
 type fakeHTTPClient struct {
 	code   int
 	header map[string][]string
+	body   string
+	err    error
+	// hosts overrides the response for requests to each host.
+	hosts map[string]fakeHTTPClient
+	// requests, if set, records each request. The first `failures` of them
+	// get a 503.
+	requests *[]*http.Request
+	failures int
 }
 
 func (m fakeHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if m.requests != nil {
+		*m.requests = append(*m.requests, req)
+		if len(*m.requests) <= m.failures {
+			return &http.Response{StatusCode: 503, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+		}
+	}
+	if host, ok := m.hosts[req.URL.Host]; ok {
+		host.requests = nil
+		return host.Do(req)
+	}
+	if m.err != nil {
+		return nil, m.err
+	}
 	if m.code == 0 {
 		m.code = 200
 	}
 	if m.header == nil {
-		m.header = map[string][]string{"Content-Length": {"200"}, "Last-Modified": {"whenever"}}
+		length := "200"
+		if m.body != "" {
+			length = strconv.Itoa(len(m.body))
+		}
+		m.header = map[string][]string{"Content-Length": {length}, "Last-Modified": {"whenever"}}
 	}
-	return &http.Response{StatusCode: m.code, Header: m.header}, nil
+	return &http.Response{StatusCode: m.code, Header: m.header, Body: io.NopCloser(strings.NewReader(m.body)), Request: req}, nil
 }
 
 type fakeDownloader struct{}
 
-func (d fakeDownloader) download(_ io.ReadCloser, _ string) (string, error) {
-	return "ABCDEFGHI", nil
+func (d fakeDownloader) download(_ io.ReadCloser, _ string) (fileHashes, error) {
+	return fileHashes{md5: "ABCDEFGHI", sha256: "JKLMNOPQR", size: 200}, nil
 }
 
 func TestAptMethodRun(t *testing.T) {
@@ -125,7 +261,10 @@ func TestAptMethodRun(t *testing.T) {
 	stdinreader, stdinwriter := io.Pipe()
 	stdoutreader, stdoutwriter := io.Pipe()
 	workMethod := NewAptMethod(bufio.NewReader(stdinreader), stdoutwriter)
-	workMethod.client = fakeHTTPClient{}
+	// The client is rebuilt for the credentials configured below.
+	workMethod.newClient = func(context.Context, *aptMethodConfig) (httpClient, error) {
+		return fakeHTTPClient{}, nil
+	}
 	workMethod.dl = fakeDownloader{}
 
 	ctx := context.Background()
@@ -145,13 +284,13 @@ func TestAptMethodRun(t *testing.T) {
 	writer.WriteMessage(Message{
 		code:        601,
 		description: "Configuration",
-		fields:      map[string][]string{"Config-Item": {"Acquire::gar::Service-Account-Email=email@domain"}},
+		fields:      []field{{"Config-Item", "Acquire::gar::Service-Account-Email=email@domain"}},
 	})
 
 	writer.WriteMessage(Message{
 		code:        600,
 		description: "URI Acquire",
-		fields:      map[string][]string{"URI": {"http://fake.uri"}, "Filename": {"/path/to/file"}},
+		fields:      []field{{"URI", "http://fake.uri"}, {"Filename", "/path/to/file"}},
 	})
 
 	msg, err = reader.ReadMessage(ctx)
@@ -212,7 +351,7 @@ func TestAptMethodRun404(t *testing.T) {
 	writer.WriteMessage(Message{
 		code:        600,
 		description: "URI Acquire",
-		fields:      map[string][]string{"URI": {"http://fake.uri"}, "Filename": {"/path/to/file"}},
+		fields:      []field{{"URI", "http://fake.uri"}, {"Filename", "/path/to/file"}},
 	})
 
 	msg, err = reader.ReadMessage(ctx)
@@ -258,7 +397,7 @@ func TestAptMethodRun304(t *testing.T) {
 	writer.WriteMessage(Message{
 		code:        600,
 		description: "URI Acquire",
-		fields:      map[string][]string{"URI": {"http://fake.uri"}, "Filename": {"/path/to/file"}},
+		fields:      []field{{"URI", "http://fake.uri"}, {"Filename", "/path/to/file"}},
 	})
 
 	msg, err = reader.ReadMessage(ctx)
@@ -307,7 +446,7 @@ func TestAptMethodRunFail(t *testing.T) {
 	writer.WriteMessage(Message{
 		code:        700,
 		description: "Malformed message",
-		fields:      map[string][]string{"": {"foo"}},
+		fields:      []field{{"", "foo"}},
 	})
 
 	// If we receive a malformed message from `apt`, we immediately bail
@@ -328,3 +467,339 @@ func TestAptMethodRunFail(t *testing.T) {
 		}
 	}
 }
+
+func TestAptMethodRunRedirect(t *testing.T) {
+
+	stdinreader, stdinwriter := io.Pipe()
+	stdoutreader, stdoutwriter := io.Pipe()
+	workMethod := NewAptMethod(bufio.NewReader(stdinreader), stdoutwriter)
+	workMethod.client = fakeHTTPClient{code: 302, header: map[string][]string{"Location": {"https://other.uri/file"}}}
+	workMethod.dl = fakeDownloader{}
+
+	ctx := context.Background()
+	ctx2, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go workMethod.Run(ctx2)
+
+	reader := MessageReader{reader: bufio.NewReader(stdoutreader)}
+	msg, err := reader.ReadMessage(ctx)
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if msg.code != 100 || msg.description != "Capabilities" {
+		t.Errorf("failed, didn't receive capabilities message")
+	}
+
+	writer := MessageWriter{writer: stdinwriter}
+	writer.WriteMessage(Message{
+		code:        601,
+		description: "Configuration",
+		fields:      []field{{"Config-Item", "Acquire::gar::Redirect-Foreign-Hosts=true"}},
+	})
+	writer.WriteMessage(Message{
+		code:        600,
+		description: "URI Acquire",
+		fields:      []field{{"URI", "ar+https://fake.uri/file"}, {"Filename", "/path/to/file"}},
+	})
+
+	msg, err = reader.ReadMessage(ctx)
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if msg.code != 103 || msg.description != "Redirect" ||
+		msg.Get("URI") != "ar+https://fake.uri/file" || msg.Get("New-URI") != "https://other.uri/file" {
+		t.Errorf("failed, didn't receive redirect message. msg is %q", msg)
+	}
+	cancel()
+
+	for _, p := range []io.Closer{stdinreader, stdinwriter, stdoutreader, stdoutwriter} {
+		if err := p.Close(); err != nil {
+			t.Errorf("Error from %v: %v", p, err)
+		}
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	var tests = []struct {
+		redirectForeignHosts bool
+		from, to             string
+		expected             error
+	}{
+		{false, "https://fake.uri/a", "https://other.uri/b", nil},
+		{true, "https://fake.uri/a", "https://fake.uri/b", nil},
+		{true, "https://fake.uri/a", "https://other.uri/b", http.ErrUseLastResponse},
+		{true, "https://fake.uri/a", "http://fake.uri/b", http.ErrUseLastResponse},
+	}
+
+	for _, tt := range tests {
+		method := &Method{config: &aptMethodConfig{redirectForeignHosts: tt.redirectForeignHosts}}
+		from, _ := http.NewRequest("GET", tt.from, nil)
+		to, _ := http.NewRequest("GET", tt.to, nil)
+		if err := method.checkRedirect(to, []*http.Request{from}); err != tt.expected {
+			t.Errorf("checkRedirect(%q -> %q) = %v, expected %v", tt.from, tt.to, err, tt.expected)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	var tests = []struct {
+		size     string
+		expected int64
+	}{
+		{"0", 0},
+		{"1024", 1024},
+		{"10K", 10 << 10},
+		{"10 MiB", 10 << 20},
+		{"2G", 2 << 30},
+		{"1tb", 1 << 40},
+	}
+
+	for _, tt := range tests {
+		if res, err := parseSize(tt.size); err != nil || res != tt.expected {
+			t.Errorf("parseSize(%q) = %v, %v, expected %v", tt.size, res, err, tt.expected)
+		}
+	}
+
+	for _, size := range []string{"", "-1", "ten", "10X", "99999999999T"} {
+		if _, err := parseSize(size); err == nil {
+			t.Errorf("parseSize(%q) succeeded, expected an error", size)
+		}
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	var tests = []struct {
+		config  aptMethodConfig
+		succeed bool
+	}{
+		{aptMethodConfig{}, true},
+		{aptMethodConfig{forceIPv4: true}, true},
+		// The test server only listens on IPv4.
+		{aptMethodConfig{forceIPv6: true}, false},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := &Method{config: &tt.config, writer: NewAptMessageWriter(&buffer)}
+		transport, err := method.newTransport(&tt.config)
+		if err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+		client := &http.Client{Transport: transport}
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), method.connTrace()))
+			resp, err := client.Do(req)
+			if (err == nil) != tt.succeed {
+				t.Fatalf("config %+v: got error %v, expected success %v", tt.config, err, tt.succeed)
+			}
+			if err != nil {
+				break
+			}
+			discardBody(resp)
+		}
+		if tt.succeed && !strings.Contains(buffer.String(), "reusing connection") {
+			t.Errorf("config %+v: expected second request to reuse the connection, got %q", tt.config, buffer.String())
+		}
+	}
+}
+
+func TestRequestURL(t *testing.T) {
+	var tests = []struct {
+		uri, expected string
+	}{
+		{
+			"ar+https://us-apt.pkg.dev/projects/p/dists/stable/InRelease",
+			"https://us-apt.pkg.dev/projects/p/dists/stable/InRelease",
+		},
+		{
+			// Only the scheme is replaced.
+			"ar+https://us-apt.pkg.dev/projects/ar+https/dists/stable/InRelease",
+			"https://us-apt.pkg.dev/projects/ar%2Bhttps/dists/stable/InRelease",
+		},
+		{
+			// Raw filename from older apt.
+			"ar+https://us-apt.pkg.dev/projects/p/pool/f/foo_1.0+1~deb_amd64.deb",
+			"https://us-apt.pkg.dev/projects/p/pool/f/foo_1.0%2B1~deb_amd64.deb",
+		},
+		{
+			// Encoded filename from apt 2.x.
+			"ar+https://us-apt.pkg.dev/projects/p/pool/f/foo_1.0%2b1%7edeb_amd64.deb",
+			"https://us-apt.pkg.dev/projects/p/pool/f/foo_1.0%2B1~deb_amd64.deb",
+		},
+		{
+			// A raw percent sign which isn't an escape.
+			"ar+https://us-apt.pkg.dev/projects/p/pool/f/100%_amd64.deb",
+			"https://us-apt.pkg.dev/projects/p/pool/f/100%25_amd64.deb",
+		},
+		{
+			"ar+https://us-apt.pkg.dev/projects/p/pool/f/with%20space.deb",
+			"https://us-apt.pkg.dev/projects/p/pool/f/with%20space.deb",
+		},
+	}
+
+	for _, tt := range tests {
+		res, err := requestURL(tt.uri)
+		if err != nil {
+			t.Errorf("requestURL(%q) failed: %v", tt.uri, err)
+			continue
+		}
+		if res.String() != tt.expected {
+			t.Errorf("requestURL(%q) = %q, expected %q", tt.uri, res.String(), tt.expected)
+		}
+	}
+
+	for _, uri := range []string{"not a uri", "ar+https:///no/host"} {
+		if _, err := requestURL(uri); err == nil {
+			t.Errorf("requestURL(%q) succeeded, expected an error", uri)
+		}
+	}
+}
+
+// errReader returns some data, then fails as a cancelled request body would.
+type errReader struct {
+	data string
+	err  error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestDownloaderImpl(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "package.deb")
+	writeTestFile(t, filename, "previous contents")
+
+	body := io.NopCloser(&errReader{data: "partial", err: context.Canceled})
+	if _, err := (downloaderImpl{}).download(body, filename); !errors.Is(err, context.Canceled) {
+		t.Fatalf("failed, expected context.Canceled, got %v", err)
+	}
+	if data, _ := os.ReadFile(filename); string(data) != "previous contents" {
+		t.Errorf("failed, interrupted download replaced file with %q", data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("failed, expected temporary file to be removed, got %v", entries)
+	}
+
+	hashes, err := (downloaderImpl{}).download(io.NopCloser(strings.NewReader("package contents")), filename)
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if hashes.sha256 != sha256Hex("package contents") || hashes.size != 16 {
+		t.Errorf("failed, unexpected hashes %+v", hashes)
+	}
+	if data, _ := os.ReadFile(filename); string(data) != "package contents" {
+		t.Errorf("failed, expected downloaded contents, got %q", data)
+	}
+}
+
+func TestNewTransportHostSettings(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	caInfo := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	writeTestFile(t, caInfo, string(cert))
+
+	method := &Method{config: &aptMethodConfig{}}
+	for _, tt := range []struct {
+		caInfo  string
+		succeed bool
+	}{
+		{"", false},
+		{caInfo, true},
+	} {
+		transport, err := method.newTransport(&aptMethodConfig{caInfo: tt.caInfo})
+		if err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if (err == nil) != tt.succeed {
+			t.Errorf("CaInfo %q: got error %v, expected success %v", tt.caInfo, err, tt.succeed)
+		}
+		if err == nil {
+			discardBody(resp)
+		}
+	}
+	if _, err := method.newTransport(&aptMethodConfig{caInfo: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Errorf("failed, expected error for missing CaInfo")
+	}
+
+	req, _ := http.NewRequest("GET", "https://us-apt.pkg.dev/", nil)
+	for proxy, expected := range map[string]string{
+		"http://proxy:3128": "http://proxy:3128",
+		"DIRECT":            "",
+	} {
+		transport, err := method.newTransport(&aptMethodConfig{proxy: proxy})
+		if err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+		var res string
+		if transport.Proxy != nil {
+			if u, _ := transport.Proxy(req); u != nil {
+				res = u.String()
+			}
+		}
+		if res != expected {
+			t.Errorf("Proxy %q: got %q, expected %q", proxy, res, expected)
+		}
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	var tests = []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{4, 16 * time.Second},
+		{5, maxRetryDelay},
+		{maxRetries, maxRetryDelay},
+		{64, maxRetryDelay},
+	}
+	for _, tt := range tests {
+		if got := retryWait(tt.attempt); got != tt.expected {
+			t.Errorf("attempt %d failed, expected: %v got: %v", tt.attempt, tt.expected, got)
+		}
+	}
+}
+
+func TestHandleAcquireRetries(t *testing.T) {
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = 0
+
+	for _, tt := range []struct {
+		retries int
+		succeed bool
+	}{
+		{0, false},
+		{1, false},
+		{2, true},
+	} {
+		var requests []*http.Request
+		method := &Method{
+			config: &aptMethodConfig{retries: tt.retries},
+			writer: NewAptMessageWriter(io.Discard),
+			client: fakeHTTPClient{failures: 2, requests: &requests},
+			dl:     fakeDownloader{},
+		}
+		err := method.handleAcquire(context.Background(), &URIAcquire{URI: "ar+https://fake.uri/file", Filename: "/path/to/file"})
+		if (err == nil) != tt.succeed {
+			t.Errorf("retries %d: got error %v, expected success %v", tt.retries, err, tt.succeed)
+		}
+		if len(requests) != tt.retries+1 {
+			t.Errorf("retries %d: got %d requests, expected %d", tt.retries, len(requests), tt.retries+1)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// metricsPrefix is the prefix of the name of every metric.
+const metricsPrefix = "artifact_registry_apt_"
+
+var (
+	tokenLatencyBuckets     = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	downloadDurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+)
+
+// requestKey labels the count of requests with each outcome.
+type requestKey struct {
+	host string
+	// code is the HTTP status, or "error" if there was no response.
+	code string
+}
+
+// metrics counts the method's activity over a session, to be added to the
+// totals in the Metrics-File for node_exporter's textfile collector.
+type metrics struct {
+	downloadedBytes  int64
+	requests         map[requestKey]int
+	retries          int
+	cacheHits        int
+	imsHits          int
+	tokenLatency     *histogram
+	downloadDuration *histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:         make(map[requestKey]int),
+		tokenLatency:     newHistogram(tokenLatencyBuckets),
+		downloadDuration: newHistogram(downloadDurationBuckets),
+	}
+}
+
+// histogram counts observations in cumulative buckets, as Prometheus does.
+type histogram struct {
+	buckets []float64
+	counts  []int
+	count   int
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]int, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// add adds the counts in `other` to `s`. Their histograms have the same
+// buckets.
+func (s *metrics) add(other *metrics) {
+	s.downloadedBytes += other.downloadedBytes
+	for key, n := range other.requests {
+		s.requests[key] += n
+	}
+	s.retries += other.retries
+	s.cacheHits += other.cacheHits
+	s.imsHits += other.imsHits
+	s.tokenLatency.add(other.tokenLatency)
+	s.downloadDuration.add(other.downloadDuration)
+}
+
+func (h *histogram) add(other *histogram) {
+	for i := range h.counts {
+		h.counts[i] += other.counts[i]
+	}
+	h.count += other.count
+	h.sum += other.sum
+}
+
+// stats returns the method's metrics.
+func (m *Method) stats() *metrics {
+	if m.metrics == nil {
+		m.metrics = newMetrics()
+	}
+	return m.metrics
+}
+
+// countRequest counts a request to `host` with the given outcome.
+func (s *metrics) countRequest(host string, resp *http.Response, err error) {
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	s.requests[requestKey{host, code}]++
+}
+
+// countAcquire counts the outcome of an acquire, which failed if `err` is
+// set. The retries of every acquire are counted, but a failed one counts
+// toward nothing else.
+func (s *metrics) countAcquire(rec *acquireRecord, err error) {
+	s.retries += rec.retries
+	if err != nil {
+		return
+	}
+	switch {
+	case rec.cacheHit:
+		s.cacheHits++
+	case rec.status == http.StatusNotModified:
+		s.imsHits++
+	case rec.status == http.StatusOK:
+		s.downloadedBytes += rec.bytes
+		s.downloadDuration.observe(time.Since(rec.start).Seconds())
+	}
+}
+
+// timedTokenSource records the latency of each token fetched from `source`.
+type timedTokenSource struct {
+	source  oauth2.TokenSource
+	latency *histogram
+}
+
+func (ts timedTokenSource) Token() (*oauth2.Token, error) {
+	start := time.Now()
+	token, err := ts.source.Token()
+	ts.latency.observe(time.Since(start).Seconds())
+	return token, err
+}
+
+// write writes the metrics in the Prometheus text format.
+func (s *metrics) write(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	counter := func(name, help string) {
+		fmt.Fprintf(b, "# HELP %s%s %s\n# TYPE %[1]s%[2]s counter\n", metricsPrefix, name, help)
+	}
+
+	counter("downloaded_bytes_total", "Bytes of files downloaded.")
+	fmt.Fprintf(b, "%sdownloaded_bytes_total %d\n", metricsPrefix, s.downloadedBytes)
+
+	counter("requests_total", "HTTP requests made, by host and status code.")
+	keys := make([]requestKey, 0, len(s.requests))
+	for key := range s.requests {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b requestKey) int {
+		return cmp.Or(cmp.Compare(a.host, b.host), cmp.Compare(a.code, b.code))
+	})
+	for _, key := range keys {
+		fmt.Fprintf(b, "%srequests_total{host=%q,code=%q} %d\n", metricsPrefix, key.host, key.code, s.requests[key])
+	}
+
+	counter("retries_total", "Fetches retried after every candidate failed.")
+	fmt.Fprintf(b, "%sretries_total %d\n", metricsPrefix, s.retries)
+	counter("cache_hits_total", "Files served from the download cache.")
+	fmt.Fprintf(b, "%scache_hits_total %d\n", metricsPrefix, s.cacheHits)
+	counter("ims_hits_total", "Files found to be unchanged since apt last fetched them.")
+	fmt.Fprintf(b, "%sims_hits_total %d\n", metricsPrefix, s.imsHits)
+
+	s.tokenLatency.write(b, "token_fetch_seconds", "Time taken to fetch access tokens.")
+	s.downloadDuration.write(b, "download_duration_seconds", "Time taken to download each file.")
+	return b.Flush()
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	name = metricsPrefix + name
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %[1]s histogram\n", name, help)
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// read adds the values of the metrics written by write to `r` to `s`. Lines
+// it doesn't recognise are skipped.
+func (s *metrics) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			continue
+		}
+		name, labels, ok := parseSeries(line[:i])
+		if !ok || !strings.HasPrefix(name, metricsPrefix) {
+			continue
+		}
+		switch name = name[len(metricsPrefix):]; name {
+		case "downloaded_bytes_total":
+			s.downloadedBytes += int64(v)
+		case "requests_total":
+			s.requests[requestKey{labels["host"], labels["code"]}] += int(v)
+		case "retries_total":
+			s.retries += int(v)
+		case "cache_hits_total":
+			s.cacheHits += int(v)
+		case "ims_hits_total":
+			s.imsHits += int(v)
+		default:
+			if suffix, ok := strings.CutPrefix(name, "token_fetch_seconds"); ok {
+				s.tokenLatency.read(suffix, labels["le"], v)
+			} else if suffix, ok := strings.CutPrefix(name, "download_duration_seconds"); ok {
+				s.downloadDuration.read(suffix, labels["le"], v)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// read adds the value `v` of the series of the histogram with `suffix` to
+// its name, and `le` label for a bucket, to `h`.
+func (h *histogram) read(suffix, le string, v float64) {
+	switch suffix {
+	case "_bucket":
+		for i, bound := range h.buckets {
+			if strconv.FormatFloat(bound, 'g', -1, 64) == le {
+				h.counts[i] += int(v)
+			}
+		}
+	case "_sum":
+		h.sum += v
+	case "_count":
+		h.count += int(v)
+	}
+}
+
+// parseSeries splits a series such as name{key="value",...} into its name
+// and labels.
+func parseSeries(series string) (name string, labels map[string]string, ok bool) {
+	name, rest, found := strings.Cut(series, "{")
+	if !found {
+		return name, nil, true
+	}
+	labels = make(map[string]string)
+	for {
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			return "", nil, false
+		}
+		quoted, err := strconv.QuotedPrefix(value)
+		if err != nil {
+			return "", nil, false
+		}
+		labels[key], _ = strconv.Unquote(quoted)
+		rest = value[len(quoted):]
+		if rest == "}" {
+			return name, labels, true
+		}
+		if rest, found = strings.CutPrefix(rest, ","); !found {
+			return "", nil, false
+		}
+	}
+}
+
+// writeMetrics adds the session's metrics to the totals in the Metrics-File,
+// if one is configured. As apt may run a method for each host at once, the
+// file is locked while it is updated, and it is replaced atomically, so that
+// node_exporter never reads a partial one.
+func (m *Method) writeMetrics() error {
+	path := m.config.metricsFile
+	if path == "" {
+		return nil
+	}
+	current, err := lockMetricsFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to write metrics: %v", err)
+	}
+	defer current.Close()
+	defer unlockFile(current)
+	total := newMetrics()
+	if err := total.read(current); err != nil {
+		return fmt.Errorf("failed to read metrics: %v", err)
+	}
+	total.add(m.stats())
+
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write metrics: %v", err)
+	}
+	defer os.Remove(file.Name())
+	err = total.write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write metrics: %v", err)
+	}
+	return nil
+}
+
+// lockMetricsFile opens the Metrics-File at `path`, creating it if need be,
+// and locks it. The lock is taken again if the file was replaced while
+// waiting for it.
+func lockMetricsFile(path string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := lockFile(f, true); err != nil {
+			f.Close()
+			return nil, err
+		}
+		locked, err := f.Stat()
+		if err != nil {
+			unlockFile(f)
+			f.Close()
+			return nil, err
+		}
+		if current, err := os.Stat(path); err == nil && os.SameFile(locked, current) {
+			return f, nil
+		}
+		unlockFile(f)
+		f.Close()
+	}
+}
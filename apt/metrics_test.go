@@ -0,0 +1,158 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = 0
+
+	dir := t.TempDir()
+	method := &Method{
+		config: &aptMethodConfig{retries: 1, metricsFile: filepath.Join(dir, "gar.prom")},
+		writer: NewAptMessageWriter(io.Discard),
+		client: fakeHTTPClient{failures: 1, requests: new([]*http.Request)},
+		dl:     fakeDownloader{},
+	}
+	if err := method.handleAcquire(context.Background(), &URIAcquire{URI: "ar+https://fake.uri/a", Filename: "/path/to/a"}); err != nil {
+		t.Fatalf("handleAcquire failed: %v", err)
+	}
+	method.client = fakeHTTPClient{code: 304}
+	if err := method.handleAcquire(context.Background(), &URIAcquire{URI: "ar+https://fake.uri/b", Filename: "/path/to/b"}); err != nil {
+		t.Fatalf("handleAcquire failed: %v", err)
+	}
+	ts := timedTokenSource{oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}), method.stats().tokenLatency}
+	if _, err := ts.Token(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := method.writeMetrics(); err != nil {
+		t.Fatalf("writeMetrics failed: %v", err)
+	}
+	data, err := os.ReadFile(method.config.metricsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"# TYPE artifact_registry_apt_downloaded_bytes_total counter\n",
+		"artifact_registry_apt_downloaded_bytes_total 200\n",
+		`artifact_registry_apt_requests_total{host="fake.uri",code="200"} 1` + "\n",
+		`artifact_registry_apt_requests_total{host="fake.uri",code="304"} 1` + "\n",
+		`artifact_registry_apt_requests_total{host="fake.uri",code="503"} 1` + "\n",
+		"artifact_registry_apt_retries_total 1\n",
+		"artifact_registry_apt_cache_hits_total 0\n",
+		"artifact_registry_apt_ims_hits_total 1\n",
+		"# TYPE artifact_registry_apt_token_fetch_seconds histogram\n",
+		`artifact_registry_apt_token_fetch_seconds_bucket{le="+Inf"} 1` + "\n",
+		"artifact_registry_apt_token_fetch_seconds_count 1\n",
+		`artifact_registry_apt_download_duration_seconds_bucket{le="300"} 1` + "\n",
+		"artifact_registry_apt_download_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("failed, expected %q in:\n%s", expected, data)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("failed, expected only the metrics file, got %v", entries)
+	}
+}
+
+func TestWriteMetricsAccumulates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gar.prom")
+	session := func(host string) *Method {
+		method := &Method{config: &aptMethodConfig{metricsFile: path}}
+		method.stats().countRequest(host, &http.Response{StatusCode: 200}, nil)
+		method.stats().countAcquire(&acquireRecord{start: time.Now(), status: 200, bytes: 100, retries: 1}, nil)
+		method.stats().tokenLatency.observe(0.2)
+		return method
+	}
+
+	// Two runs one after the other, then several at once, as apt runs one
+	// method for each host.
+	if err := session("us-apt.pkg.dev").writeMetrics(); err != nil {
+		t.Fatalf("writeMetrics failed: %v", err)
+	}
+	if err := session("us-apt.pkg.dev").writeMetrics(); err != nil {
+		t.Fatalf("writeMetrics failed: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := session("europe-apt.pkg.dev").writeMetrics(); err != nil {
+				t.Errorf("writeMetrics failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"artifact_registry_apt_downloaded_bytes_total 600\n",
+		`artifact_registry_apt_requests_total{host="europe-apt.pkg.dev",code="200"} 4` + "\n",
+		`artifact_registry_apt_requests_total{host="us-apt.pkg.dev",code="200"} 2` + "\n",
+		"artifact_registry_apt_retries_total 6\n",
+		`artifact_registry_apt_token_fetch_seconds_bucket{le="0.1"} 0` + "\n",
+		`artifact_registry_apt_token_fetch_seconds_bucket{le="0.25"} 6` + "\n",
+		"artifact_registry_apt_token_fetch_seconds_count 6\n",
+		"artifact_registry_apt_download_duration_seconds_count 6\n",
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("failed, expected %q in:\n%s", expected, data)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 5})
+	for _, v := range []float64{0.5, 1, 3, 10} {
+		h.observe(v)
+	}
+	var b strings.Builder
+	h.write(&b, "test_seconds", "Test.")
+	expected := `# HELP artifact_registry_apt_test_seconds Test.
+# TYPE artifact_registry_apt_test_seconds histogram
+artifact_registry_apt_test_seconds_bucket{le="1"} 2
+artifact_registry_apt_test_seconds_bucket{le="5"} 3
+artifact_registry_apt_test_seconds_bucket{le="+Inf"} 4
+artifact_registry_apt_test_seconds_sum 14.5
+artifact_registry_apt_test_seconds_count 4
+`
+	if b.String() != expected {
+		t.Errorf("failed, expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
@@ -0,0 +1,110 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"strings"
+)
+
+// mirrorsConfigPrefix is the config key prefix for mirror lists. Each item
+// has the form `Acquire::gar::Mirrors::<prefix>::=<alternate>`, as produced by
+// a list under a quoted repository prefix in apt.conf.
+const mirrorsConfigPrefix = "Acquire::gar::Mirrors::"
+
+// normalizeMirrorPrefix strips the scheme and any trailing slash, leaving
+// "host/path".
+func normalizeMirrorPrefix(s string) string {
+	if idx := strings.Index(s, "://"); idx != -1 {
+		s = s[idx+len("://"):]
+	}
+	return strings.TrimRight(s, "/")
+}
+
+// addMirror records `alternate` as a mirror of the repository identified by
+// `key`, which is the remainder of a config key after mirrorsConfigPrefix.
+func (c *aptMethodConfig) addMirror(key, alternate string) {
+	if idx := strings.LastIndex(key, "::"); idx != -1 {
+		key = key[:idx]
+	}
+	prefix := normalizeMirrorPrefix(key)
+	alternate = normalizeMirrorPrefix(alternate)
+	if prefix == "" || alternate == "" {
+		return
+	}
+	if c.mirrors == nil {
+		c.mirrors = make(map[string][]string)
+	}
+	c.mirrors[prefix] = append(c.mirrors[prefix], alternate)
+}
+
+// mirrorCandidates returns the URLs to try for `realuri`, which must be an
+// https URL. The URL itself is always a candidate; if it falls under a
+// configured mirror prefix, the corresponding URLs on each alternate follow
+// in configured order. Candidates on hosts which have already failed during
+// this session are moved to the end.
+func (m *Method) mirrorCandidates(realuri string) []string {
+	const scheme = "https://"
+	if !strings.HasPrefix(realuri, scheme) {
+		return []string{realuri}
+	}
+	path := strings.TrimPrefix(realuri, scheme)
+
+	// Use the longest matching prefix.
+	var prefix string
+	for p := range m.config.mirrors {
+		if (path == p || strings.HasPrefix(path, p+"/")) && len(p) > len(prefix) {
+			prefix = p
+		}
+	}
+	if prefix == "" {
+		return []string{realuri}
+	}
+
+	rest := strings.TrimPrefix(path, prefix)
+	candidates := []string{realuri}
+	for _, alternate := range m.config.mirrors[prefix] {
+		candidates = append(candidates, scheme+alternate+rest)
+	}
+
+	var healthy, unhealthy []string
+	for _, candidate := range candidates {
+		if m.unhealthy[hostOf(candidate)] {
+			unhealthy = append(unhealthy, candidate)
+		} else {
+			healthy = append(healthy, candidate)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// markUnhealthy records that `host` has failed, so that later acquires
+// prefer other mirrors.
+func (m *Method) markUnhealthy(host string) {
+	if m.unhealthy == nil {
+		m.unhealthy = make(map[string]bool)
+	}
+	m.unhealthy[host] = true
+}
+
+// hostOf returns the host portion of an http(s) URL.
+func hostOf(uri string) string {
+	if idx := strings.Index(uri, "://"); idx != -1 {
+		uri = uri[idx+len("://"):]
+	}
+	if idx := strings.IndexByte(uri, '/'); idx != -1 {
+		uri = uri[:idx]
+	}
+	return uri
+}
@@ -0,0 +1,206 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// requestedHosts returns the hosts `requests` were sent to.
+func requestedHosts(requests []*http.Request) []string {
+	var hosts []string
+	for _, req := range requests {
+		hosts = append(hosts, req.URL.Host)
+	}
+	return hosts
+}
+
+func TestAddMirror(t *testing.T) {
+	config := &aptMethodConfig{}
+	config.addMirror("us-apt.pkg.dev/projects/p/::", "https://europe-apt.pkg.dev/projects/p/")
+	config.addMirror("https://us-apt.pkg.dev/projects/p::", "asia-apt.pkg.dev/projects/p")
+	config.addMirror("::", "nowhere")
+
+	expected := map[string][]string{
+		"us-apt.pkg.dev/projects/p": {"europe-apt.pkg.dev/projects/p", "asia-apt.pkg.dev/projects/p"},
+	}
+	if !reflect.DeepEqual(config.mirrors, expected) {
+		t.Errorf("failed, expected: %v got: %v", expected, config.mirrors)
+	}
+}
+
+func TestMirrorCandidates(t *testing.T) {
+	var tests = []struct {
+		uri       string
+		unhealthy map[string]bool
+		expected  []string
+	}{
+		{
+			// No matching prefix.
+			"https://us-apt.pkg.dev/projects/other/dists/stable/Release",
+			nil,
+			[]string{"https://us-apt.pkg.dev/projects/other/dists/stable/Release"},
+		},
+		{
+			// Prefix must match whole path components.
+			"https://us-apt.pkg.dev/projects/p2/dists/stable/Release",
+			nil,
+			[]string{"https://us-apt.pkg.dev/projects/p2/dists/stable/Release"},
+		},
+		{
+			"https://us-apt.pkg.dev/projects/p/dists/stable/Release",
+			nil,
+			[]string{
+				"https://us-apt.pkg.dev/projects/p/dists/stable/Release",
+				"https://europe-apt.pkg.dev/projects/p/dists/stable/Release",
+				"https://asia-apt.pkg.dev/projects/p/dists/stable/Release",
+			},
+		},
+		{
+			// Unhealthy hosts are tried last.
+			"https://us-apt.pkg.dev/projects/p/dists/stable/Release",
+			map[string]bool{"us-apt.pkg.dev": true},
+			[]string{
+				"https://europe-apt.pkg.dev/projects/p/dists/stable/Release",
+				"https://asia-apt.pkg.dev/projects/p/dists/stable/Release",
+				"https://us-apt.pkg.dev/projects/p/dists/stable/Release",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		method := &Method{
+			config: &aptMethodConfig{mirrors: map[string][]string{
+				"us-apt.pkg.dev/projects/p": {"europe-apt.pkg.dev/projects/p", "asia-apt.pkg.dev/projects/p"},
+			}},
+			unhealthy: tt.unhealthy,
+		}
+		if res := method.mirrorCandidates(tt.uri); !reflect.DeepEqual(res, tt.expected) {
+			t.Errorf("failed, expected: %v got: %v", tt.expected, res)
+		}
+	}
+}
+
+func TestHandleAcquireMirrorFailover(t *testing.T) {
+	var requests []*http.Request
+	var buffer bytes.Buffer
+	method := &Method{
+		config: &aptMethodConfig{mirrors: map[string][]string{
+			"us-apt.pkg.dev/projects/p": {"europe-apt.pkg.dev/projects/p", "asia-apt.pkg.dev/projects/p"},
+		}},
+		writer: NewAptMessageWriter(&buffer),
+		client: fakeHTTPClient{
+			hosts: map[string]fakeHTTPClient{
+				"us-apt.pkg.dev":     {err: errors.New("connection refused")},
+				"europe-apt.pkg.dev": {code: 503},
+			},
+			requests: &requests,
+		},
+		dl: fakeDownloader{},
+	}
+	req := &URIAcquire{
+		URI:      "ar+https://us-apt.pkg.dev/projects/p/dists/stable/Release",
+		Filename: "/path/to/file",
+	}
+
+	if err := method.handleAcquire(context.Background(), req); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	expected := []string{"us-apt.pkg.dev", "europe-apt.pkg.dev", "asia-apt.pkg.dev"}
+	if requested := requestedHosts(requests); !reflect.DeepEqual(requested, expected) {
+		t.Errorf("failed, expected requests to %v got %v", expected, requested)
+	}
+	if !strings.Contains(buffer.String(), "served by mirror asia-apt.pkg.dev") {
+		t.Errorf("failed, serving mirror not logged in %q", buffer.String())
+	}
+	if !strings.Contains(buffer.String(), "201 URI Done") {
+		t.Errorf("failed, didn't receive uri done message in %q", buffer.String())
+	}
+
+	// Failed hosts are remembered for the rest of the session.
+	requests = nil
+	if err := method.handleAcquire(context.Background(), req); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if requested := requestedHosts(requests); len(requested) != 1 || requested[0] != "asia-apt.pkg.dev" {
+		t.Errorf("failed, expected only a request to the healthy mirror, got %v", requested)
+	}
+}
+
+func TestHandleAcquireMirrorsAllFail(t *testing.T) {
+	var buffer bytes.Buffer
+	method := &Method{
+		config: &aptMethodConfig{mirrors: map[string][]string{
+			"us-apt.pkg.dev/projects/p": {"europe-apt.pkg.dev/projects/p"},
+		}},
+		writer: NewAptMessageWriter(&buffer),
+		client: fakeHTTPClient{
+			hosts: map[string]fakeHTTPClient{
+				"us-apt.pkg.dev":     {code: 500},
+				"europe-apt.pkg.dev": {code: 502},
+			},
+		},
+		dl: fakeDownloader{},
+	}
+	req := &URIAcquire{
+		URI:      "ar+https://us-apt.pkg.dev/projects/p/dists/stable/Release",
+		Filename: "/path/to/file",
+	}
+
+	err := method.handleAcquire(context.Background(), req)
+	if err == nil || !strings.Contains(err.Error(), "code 502") {
+		t.Fatalf("failed, expected the last mirror's error, got %v", err)
+	}
+}
+
+func TestHandleAcquireMirrorHostOverrides(t *testing.T) {
+	var configs []*aptMethodConfig
+	method := &Method{
+		config: &aptMethodConfig{},
+		writer: NewAptMessageWriter(io.Discard),
+		dl:     fakeDownloader{},
+		// Only a client built with the mirror's own settings succeeds.
+		newClient: func(_ context.Context, config *aptMethodConfig) (httpClient, error) {
+			configs = append(configs, config)
+			if config.timeout == 60*time.Second {
+				return fakeHTTPClient{}, nil
+			}
+			return fakeHTTPClient{code: 503}, nil
+		},
+	}
+	method.handleConfigure(&Configuration{ConfigItems: []string{
+		"Acquire::gar::us-apt.pkg.dev::Mirrors::=europe-apt.pkg.dev",
+		"Acquire::gar::europe-apt.pkg.dev::Timeout=60",
+	}})
+	req := &URIAcquire{
+		URI:      "ar+https://us-apt.pkg.dev/projects/p/dists/stable/Release",
+		Filename: "/path/to/file",
+	}
+
+	if err := method.handleAcquire(context.Background(), req); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if len(configs) != 2 || configs[1].timeout != 60*time.Second {
+		t.Errorf("failed, expected a client for the mirror's settings, got %+v", configs)
+	}
+}
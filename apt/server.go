@@ -0,0 +1,364 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Handler implements the logic of an apt method. A Server drives it,
+// handling the protocol on its behalf.
+type Handler interface {
+	// Configure is called for each 601 Configuration message. An error is
+	// logged, but doesn't stop the method.
+	Configure(ctx context.Context, w *MessageWriter, config *Configuration) error
+	// Acquire is called for each 600 URI Acquire message, which is
+	// guaranteed to have a URI and Filename. On success it must have written
+	// a 201 URI Done (or 103 Redirect) for the URI to `w`. If it returns an
+	// error or panics, the Server reports a 400 URI Failure for the URI;
+	// returning a *URIFailure allows the handler to control the fields sent.
+	Acquire(ctx context.Context, w *MessageWriter, req *URIAcquire) error
+}
+
+// Server runs the apt method protocol over a pair of streams, normally stdin
+// and stdout, dispatching requests to a Handler.
+type Server struct {
+	handler        Handler
+	reader         *MessageReader
+	writer         *MessageWriter
+	capabilities   Capabilities
+	maxConcurrency int
+	unknown        UnknownMessagePolicy
+	stackTraces    func() bool
+	start          func(w *MessageWriter)
+	// interrupted is set if an acquire fails because the context is done.
+	interrupted atomic.Bool
+
+	mu      sync.Mutex
+	summary Summary
+}
+
+// UnknownMessagePolicy decides how a Server responds to messages with a code
+// it doesn't handle.
+type UnknownMessagePolicy int
+
+const (
+	// LogUnknownMessages logs and ignores the message. This is the default,
+	// since apt sends messages which most methods have no use for, like 602
+	// Media Changed, and newer versions may add more.
+	LogUnknownMessages UnknownMessagePolicy = iota
+	// FailUnknownMessages sends a 401 General Failure, after which apt stops
+	// using the method.
+	FailUnknownMessages
+)
+
+// Summary describes the acquires handled by a Server.
+type Summary struct {
+	Succeeded int
+	// Failures holds the failure reported for each URI which wasn't acquired.
+	Failures []URIFailure
+}
+
+// String formats the summary for logging.
+func (s Summary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d acquired, %d failed", s.Succeeded, len(s.Failures))
+	for _, f := range s.Failures {
+		fmt.Fprintf(&b, "\n%s: %s", f.URI, f.Message)
+	}
+	return b.String()
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithPipeline advertises that the method can accept multiple requests
+// before responding to the first.
+func WithPipeline(pipeline bool) Option {
+	return func(s *Server) { s.capabilities.Pipeline = pipeline }
+}
+
+// WithSingleInstance advertises that apt should only start one instance of
+// the method.
+func WithSingleInstance(single bool) Option {
+	return func(s *Server) { s.capabilities.SingleInstance = single }
+}
+
+// WithSendConfig asks apt to send its configuration in a 601 Configuration
+// message.
+func WithSendConfig(sendConfig bool) Option {
+	return func(s *Server) { s.capabilities.SendConfig = sendConfig }
+}
+
+// WithLocalOnly advertises that the method only accesses local files.
+func WithLocalOnly(localOnly bool) Option {
+	return func(s *Server) { s.capabilities.LocalOnly = localOnly }
+}
+
+// WithSendURIEncoded advertises that the method accepts percent-encoded
+// URIs, which apt 2.x then sends.
+func WithSendURIEncoded(encoded bool) Option {
+	return func(s *Server) { s.capabilities.SendURIEncoded = encoded }
+}
+
+// WithMaxConcurrency allows up to `n` acquires to be handled at once. The
+// Handler must then be safe for concurrent use. Configuration is never
+// applied while acquires are in flight. The default is 1.
+func WithMaxConcurrency(n int) Option {
+	return func(s *Server) { s.maxConcurrency = n }
+}
+
+// WithUnknownMessages sets the policy for messages with an unhandled code.
+func WithUnknownMessages(policy UnknownMessagePolicy) Option {
+	return func(s *Server) { s.unknown = policy }
+}
+
+// WithStackTraces logs the stack trace of a panic in Handler.Acquire whenever
+// `enabled` returns true. A panic always fails the URI being acquired, rather
+// than the whole method.
+func WithStackTraces(enabled func() bool) Option {
+	return func(s *Server) { s.stackTraces = enabled }
+}
+
+// WithStart calls `start` once the capabilities have been sent, before any
+// request is read, so that it can log to `w`.
+func WithStart(start func(w *MessageWriter)) Option {
+	return func(s *Server) { s.start = start }
+}
+
+// WithReaderLimits bounds the size of messages read from apt. A message
+// exceeding a limit is logged and skipped.
+func WithReaderLimits(limits ReaderLimits) Option {
+	return func(s *Server) { s.reader.SetLimits(limits) }
+}
+
+// NewServer returns a Server which reads requests from `input` and writes
+// responses to `output`.
+func NewServer(handler Handler, input *bufio.Reader, output io.Writer, opts ...Option) *Server {
+	s := &Server{
+		handler:        handler,
+		reader:         NewAptMessageReader(input),
+		writer:         NewAptMessageWriter(output),
+		capabilities:   Capabilities{Version: "1.0"},
+		maxConcurrency: 1,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Writer returns the writer used for responses, which is also passed to the
+// Handler.
+func (s *Server) Writer() *MessageWriter {
+	return s.writer
+}
+
+// Serve sends the method's capabilities, then handles messages until apt
+// closes the input, `ctx` is done or writing to apt fails. Cancelling `ctx`
+// aborts any acquires in flight; Serve then returns nil if the method was
+// idle, or sends a 401 General Failure and returns the context's error.
+// Before returning, the session Summary is logged if any acquire failed.
+func (s *Server) Serve(ctx context.Context) error {
+	err := s.serve(ctx)
+	if summary := s.Summary(); len(summary.Failures) > 0 {
+		s.writer.Log("session summary: " + summary.String())
+	}
+	return err
+}
+
+// Summary returns the outcome of the acquires handled so far.
+func (s *Server) Summary() Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summary := s.summary
+	summary.Failures = append([]URIFailure(nil), s.summary.Failures...)
+	return summary
+}
+
+func (s *Server) serve(ctx context.Context) error {
+	if err := s.writer.Send(s.capabilities); err != nil {
+		return err
+	}
+	if s.start != nil {
+		s.start(s.writer)
+	}
+
+	// Once apt can't be told about the results, stop downloading.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		select {
+		case <-s.writer.Done():
+			cancel(s.writer.Err())
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	sem := make(chan struct{}, max(s.maxConcurrency, 1))
+
+	for {
+		msg, err := s.reader.ReadMessage(ctx)
+		if writeErr := s.writer.Err(); writeErr != nil {
+			wg.Wait()
+			return writeErr
+		}
+		if ctx.Err() != nil {
+			wg.Wait()
+			return s.shutdown(ctx)
+		}
+		var limitErr *LimitError
+		if errors.Is(err, errEmptyMessage) {
+			continue
+		} else if errors.As(err, &limitErr) {
+			s.writer.Log(fmt.Sprintf("skipping message: %v", err))
+			continue
+		} else if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch msg.code {
+		case 600:
+			req, ok := s.parseAcquire(msg)
+			if !ok {
+				continue
+			}
+			if s.maxConcurrency <= 1 {
+				s.acquire(ctx, req)
+				continue
+			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				s.acquire(ctx, req)
+			}()
+		case 601:
+			wg.Wait()
+			var config Configuration
+			if err := Unmarshal(msg, &config); err != nil {
+				s.writer.Log(err.Error())
+				continue
+			}
+			if err := s.handler.Configure(ctx, s.writer, &config); err != nil {
+				s.writer.Log(fmt.Sprintf("configuration failed: %v", err))
+			}
+		default:
+			if s.unknown == FailUnknownMessages {
+				s.writer.Fail(fmt.Sprintf("Unsupported message code %d received from apt", msg.code))
+				continue
+			}
+			s.writer.Log(fmt.Sprintf("ignoring unsupported message %d %s", msg.code, msg.description))
+		}
+	}
+}
+
+// parseAcquire validates a 600 URI Acquire message, reporting any problem to
+// apt.
+func (s *Server) parseAcquire(msg *Message) (*URIAcquire, bool) {
+	req := &URIAcquire{}
+	err := Unmarshal(msg, req)
+	switch {
+	case req.URI == "":
+		s.writer.Fail("no URI provided in Acquire message")
+	case err != nil:
+		s.fail(URIFailure{URI: req.URI, Message: err.Error()})
+	case req.Filename == "":
+		s.fail(URIFailure{URI: req.URI, Message: "no filename provided in Acquire message"})
+	default:
+		return req, true
+	}
+	return nil, false
+}
+
+// shutdown is called once `ctx` is done and all acquires have returned. If
+// none were cut short the method was idle, which apt treats as a normal exit.
+// Otherwise apt is told the method failed, as it may still be waiting on the
+// interrupted URIs.
+func (s *Server) shutdown(ctx context.Context) error {
+	if !s.interrupted.Load() {
+		return nil
+	}
+	s.writer.Fail(fmt.Sprintf("interrupted: %v", context.Cause(ctx)))
+	return ctx.Err()
+}
+
+// acquire runs the Handler for one request and reports any error it returns.
+func (s *Server) acquire(ctx context.Context, req *URIAcquire) {
+	err := s.callAcquire(ctx, req)
+	if err == nil {
+		s.mu.Lock()
+		s.summary.Succeeded++
+		s.mu.Unlock()
+		return
+	}
+	failure := URIFailure{Message: err.Error()}
+	var f *URIFailure
+	if errors.As(err, &f) {
+		failure = *f
+	}
+	failure.URI = req.URI
+	if ctx.Err() != nil {
+		// Reported as a General Failure by shutdown.
+		s.interrupted.Store(true)
+		s.record(failure)
+		return
+	}
+	s.fail(failure)
+}
+
+// callAcquire runs the Handler, turning a panic into an error.
+func (s *Server) callAcquire(ctx context.Context, req *URIAcquire) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if s.stackTraces != nil && s.stackTraces() {
+			s.writer.Log(fmt.Sprintf("panic acquiring %s: %v\n%s", req.URI, r, debug.Stack()))
+		}
+		err = fmt.Errorf("internal error: %v", r)
+	}()
+	return s.handler.Acquire(ctx, s.writer, req)
+}
+
+// fail reports a failed URI to apt and records it in the summary.
+func (s *Server) fail(failure URIFailure) {
+	s.record(failure)
+	s.writer.Send(failure)
+}
+
+func (s *Server) record(failure URIFailure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.summary.Failures = append(s.summary.Failures, failure)
+}
+
+// Error allows a *URIFailure to be returned from Handler.Acquire.
+func (f *URIFailure) Error() string {
+	return f.Message
+}
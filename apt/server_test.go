@@ -0,0 +1,441 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeHandler records configuration and answers acquires with `acquire`.
+type fakeHandler struct {
+	mu      sync.Mutex
+	config  []string
+	acquire func(ctx context.Context, w *MessageWriter, req *URIAcquire) error
+}
+
+func (h *fakeHandler) Configure(ctx context.Context, w *MessageWriter, config *Configuration) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.config = append(h.config, config.ConfigItems...)
+	return nil
+}
+
+func (h *fakeHandler) Acquire(ctx context.Context, w *MessageWriter, req *URIAcquire) error {
+	return h.acquire(ctx, w, req)
+}
+
+// startServer runs a Server for `handler` over pipes, returning a reader for
+// its responses and a writer for requests. The returned channel receives the
+// result of Serve.
+func startServer(t *testing.T, handler Handler, opts ...Option) (*MessageReader, *MessageWriter, <-chan error) {
+	return startServerContext(context.Background(), t, handler, opts...)
+}
+
+// startServerContext is startServer, with Serve using a child of `ctx`.
+func startServerContext(ctx context.Context, t *testing.T, handler Handler, opts ...Option) (*MessageReader, *MessageWriter, <-chan error) {
+	stdinreader, stdinwriter := io.Pipe()
+	stdoutreader, stdoutwriter := io.Pipe()
+	server := NewServer(handler, bufio.NewReader(stdinreader), stdoutwriter, opts...)
+
+	ctx, cancel := context.WithCancel(ctx)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.Serve(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		for _, p := range []io.Closer{stdinreader, stdinwriter, stdoutreader, stdoutwriter} {
+			p.Close()
+		}
+	})
+	return NewAptMessageReader(bufio.NewReader(stdoutreader)), NewAptMessageWriter(stdinwriter), errChan
+}
+
+func TestServerCapabilities(t *testing.T) {
+	handler := &fakeHandler{}
+	reader, _, _ := startServer(t, handler, WithPipeline(true), WithSingleInstance(true), WithSendConfig(true), WithLocalOnly(true), WithSendURIEncoded(true))
+
+	msg, err := reader.ReadMessage(context.Background())
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	var caps Capabilities
+	if err := Unmarshal(msg, &caps); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	expected := Capabilities{Version: "1.0", Pipeline: true, SingleInstance: true, SendConfig: true, LocalOnly: true, SendURIEncoded: true}
+	if caps != expected {
+		t.Errorf("failed, expected: %+v got: %+v", expected, caps)
+	}
+}
+
+func TestServerStart(t *testing.T) {
+	handler := &fakeHandler{}
+	reader, _, _ := startServer(t, handler, WithStart(func(w *MessageWriter) { w.Log("started") }))
+
+	ctx := context.Background()
+	if msg, err := reader.ReadMessage(ctx); err != nil || msg.code != 100 {
+		t.Fatalf("failed, expected capabilities got: %v %v", msg, err)
+	}
+	msg, err := reader.ReadMessage(ctx)
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	var log Log
+	if err := Unmarshal(msg, &log); err != nil || log.Message != "started" {
+		t.Errorf("failed, expected: started got: %v %v", msg, err)
+	}
+}
+
+func TestServerAcquire(t *testing.T) {
+	handler := &fakeHandler{
+		acquire: func(ctx context.Context, w *MessageWriter, req *URIAcquire) error {
+			switch req.URI {
+			case "fake://ok":
+				return w.Send(URIDone{URI: req.URI, Filename: req.Filename})
+			case "fake://transient":
+				return &URIFailure{Message: "try again", FailReason: "Timeout", Transient: true}
+			default:
+				return errors.New("not found")
+			}
+		},
+	}
+	reader, writer, _ := startServer(t, handler, WithSendConfig(true))
+	ctx := context.Background()
+	if _, err := reader.ReadMessage(ctx); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+
+	var tests = []struct {
+		req      *Message
+		expected Message
+	}{
+		{
+			Marshal(URIAcquire{URI: "fake://ok", Filename: "/path/to/file"}),
+			Message{code: 201, description: "URI Done", fields: []field{{"URI", "fake://ok"}, {"Filename", "/path/to/file"}}},
+		},
+		{
+			Marshal(URIAcquire{URI: "fake://missing", Filename: "/path/to/file"}),
+			Message{code: 400, description: "URI Failure", fields: []field{{"URI", "fake://missing"}, {"Message", "not found"}}},
+		},
+		{
+			Marshal(URIAcquire{URI: "fake://transient", Filename: "/path/to/file"}),
+			Message{code: 400, description: "URI Failure", fields: []field{
+				{"URI", "fake://transient"}, {"Message", "try again"}, {"FailReason", "Timeout"}, {"Transient", "true"},
+			}},
+		},
+		{
+			// The handler is never called without a filename.
+			&Message{code: 600, description: "URI Acquire", fields: []field{{"URI", "fake://ok"}}},
+			Message{code: 400, description: "URI Failure", fields: []field{{"URI", "fake://ok"}, {"Message", "no filename provided in Acquire message"}}},
+		},
+		{
+			&Message{code: 600, description: "URI Acquire", fields: []field{{"Filename", "/path/to/file"}}},
+			Message{code: 401, description: "General Failure", fields: []field{{"Message", "no URI provided in Acquire message"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		writer.WriteMessage(*tt.req)
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+		if msg.String() != tt.expected.String() {
+			t.Errorf("failed, expected:\n%q\ngot:\n%q", tt.expected.String(), msg.String())
+		}
+	}
+}
+
+func TestServerConcurrency(t *testing.T) {
+	// Each acquire waits until both are in flight, so this deadlocks unless
+	// they run concurrently.
+	var started sync.WaitGroup
+	started.Add(2)
+	handler := &fakeHandler{
+		acquire: func(ctx context.Context, w *MessageWriter, req *URIAcquire) error {
+			started.Done()
+			started.Wait()
+			return w.Send(URIDone{URI: req.URI, Filename: req.Filename})
+		},
+	}
+	reader, writer, _ := startServer(t, handler, WithMaxConcurrency(2))
+	ctx := context.Background()
+	if _, err := reader.ReadMessage(ctx); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+
+	writer.Send(URIAcquire{URI: "fake://one", Filename: "/path/to/one"})
+	writer.Send(URIAcquire{URI: "fake://two", Filename: "/path/to/two"})
+	writer.Send(Configuration{ConfigItems: []string{"a=1"}})
+
+	done := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+		if msg.code != 201 {
+			t.Fatalf("failed, expected uri done message, got %q", msg)
+		}
+		done[msg.Get("URI")] = true
+	}
+	if !done["fake://one"] || !done["fake://two"] {
+		t.Errorf("failed, expected both acquires to complete, got %v", done)
+	}
+}
+
+func TestServerUnsupportedMessage(t *testing.T) {
+	handler := &fakeHandler{
+		acquire: func(ctx context.Context, w *MessageWriter, req *URIAcquire) error {
+			return w.Send(URIDone{URI: req.URI, Filename: req.Filename})
+		},
+	}
+	reader, writer, _ := startServer(t, handler)
+	ctx := context.Background()
+	if _, err := reader.ReadMessage(ctx); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+
+	writer.WriteMessage(Message{code: 602, description: "Media Changed", fields: []field{{"Media", "disk"}}})
+	msg, err := reader.ReadMessage(ctx)
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if msg.code != 101 {
+		t.Errorf("failed, expected log message, got %q", msg)
+	}
+
+	// The method keeps working.
+	writer.Send(URIAcquire{URI: "fake://ok", Filename: "/path/to/file"})
+	msg, err = reader.ReadMessage(ctx)
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if msg.code != 201 {
+		t.Errorf("failed, expected uri done message, got %q", msg)
+	}
+}
+
+func TestServerUnsupportedMessageFail(t *testing.T) {
+	reader, writer, _ := startServer(t, &fakeHandler{}, WithUnknownMessages(FailUnknownMessages))
+	ctx := context.Background()
+	if _, err := reader.ReadMessage(ctx); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+
+	writer.WriteMessage(Message{code: 123, description: "Fake"})
+	msg, err := reader.ReadMessage(ctx)
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if msg.code != 401 {
+		t.Errorf("failed, expected general failure message, got %q", msg)
+	}
+}
+
+func TestServerSummary(t *testing.T) {
+	handler := &fakeHandler{
+		acquire: func(ctx context.Context, w *MessageWriter, req *URIAcquire) error {
+			if req.URI == "fake://missing" {
+				return errors.New("not found")
+			}
+			return w.Send(URIDone{URI: req.URI, Filename: req.Filename})
+		},
+	}
+	var input, output bytes.Buffer
+	requests := NewAptMessageWriter(&input)
+	for _, uri := range []string{"fake://ok", "fake://missing", "fake://other"} {
+		requests.Send(URIAcquire{URI: uri, Filename: "/path/to/file"})
+	}
+	server := NewServer(handler, bufio.NewReader(&input), &output)
+	if err := server.Serve(context.Background()); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+
+	expected := Summary{Succeeded: 2, Failures: []URIFailure{{URI: "fake://missing", Message: "not found"}}}
+	if res := server.Summary(); !reflect.DeepEqual(res, expected) {
+		t.Errorf("failed, expected: %+v got: %+v", expected, res)
+	}
+	if !strings.Contains(output.String(), "session summary: 2 acquired, 1 failed") {
+		t.Errorf("failed, summary wasn't logged in %q", output.String())
+	}
+}
+
+func TestServerCancelIdle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, _, errChan := startServerContext(ctx, t, &fakeHandler{})
+	if _, err := reader.ReadMessage(context.Background()); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+
+	// Serve is blocked reading stdin, which is never closed.
+	cancel()
+	if err := <-errChan; err != nil {
+		t.Errorf("failed, expected clean exit when idle, got %v", err)
+	}
+}
+
+func TestServerCancelAcquire(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	handler := &fakeHandler{
+		acquire: func(ctx context.Context, w *MessageWriter, req *URIAcquire) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	reader, writer, errChan := startServerContext(ctx, t, handler)
+	if _, err := reader.ReadMessage(context.Background()); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	writer.Send(URIAcquire{URI: "fake://slow", Filename: "/path/to/file"})
+	<-started
+	cancel()
+
+	msg, err := reader.ReadMessage(context.Background())
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if msg.code != 401 || !strings.Contains(msg.Get("Message"), "interrupted") {
+		t.Errorf("failed, expected interrupted general failure, got %q", msg)
+	}
+	if err := <-errChan; !errors.Is(err, context.Canceled) {
+		t.Errorf("failed, expected context.Canceled, got %v", err)
+	}
+}
+
+func TestServerAcquirePanic(t *testing.T) {
+	handler := &fakeHandler{
+		acquire: func(ctx context.Context, w *MessageWriter, req *URIAcquire) error {
+			if req.URI == "fake://panic" {
+				var m map[string]bool
+				m["boom"] = true
+			}
+			return w.Send(URIDone{URI: req.URI, Filename: req.Filename})
+		},
+	}
+	for _, traces := range []bool{false, true} {
+		reader, writer, _ := startServer(t, handler, WithMaxConcurrency(2), WithStackTraces(func() bool { return traces }))
+		ctx := context.Background()
+		if _, err := reader.ReadMessage(ctx); err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+
+		writer.Send(URIAcquire{URI: "fake://panic", Filename: "/path/to/file"})
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+		if traces {
+			if msg.code != 101 || !strings.Contains(msg.Get("Message"), "goroutine") {
+				t.Errorf("failed, expected stack trace, got %q", msg)
+			}
+			if msg, err = reader.ReadMessage(ctx); err != nil {
+				t.Fatalf("failed, %v", err)
+			}
+		}
+		if msg.code != 400 || msg.Get("URI") != "fake://panic" || !strings.Contains(msg.Get("Message"), "assignment to entry in nil map") {
+			t.Errorf("failed, expected uri failure message, got %q", msg)
+		}
+
+		// The method keeps serving requests.
+		writer.Send(URIAcquire{URI: "fake://ok", Filename: "/path/to/file"})
+		if msg, err = reader.ReadMessage(ctx); err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+		if msg.code != 201 {
+			t.Errorf("failed, expected uri done message, got %q", msg)
+		}
+	}
+}
+
+func TestServerReaderLimits(t *testing.T) {
+	handler := &fakeHandler{
+		acquire: func(ctx context.Context, w *MessageWriter, req *URIAcquire) error {
+			return w.Send(URIDone{URI: req.URI, Filename: req.Filename})
+		},
+	}
+	reader, writer, _ := startServer(t, handler, WithReaderLimits(ReaderLimits{MaxFields: 4}))
+	ctx := context.Background()
+	if _, err := reader.ReadMessage(ctx); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+
+	writer.Send(Configuration{ConfigItems: []string{"A=1", "B=2", "C=3", "D=4", "E=5"}})
+	msg, err := reader.ReadMessage(ctx)
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if msg.code != 101 || !strings.Contains(msg.Get("Message"), "maximum field count") {
+		t.Errorf("failed, expected log message, got %q", msg)
+	}
+
+	writer.Send(URIAcquire{URI: "fake://ok", Filename: "/path/to/file"})
+	if msg, err = reader.ReadMessage(ctx); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if msg.code != 201 {
+		t.Errorf("failed, expected uri done message, got %q", msg)
+	}
+}
+
+// brokenWriter accepts `n` writes, then fails like a closed pipe.
+type brokenWriter struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (w *brokenWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.n == 0 {
+		return 0, io.ErrClosedPipe
+	}
+	w.n--
+	return len(p), nil
+}
+
+func TestServerBrokenOutput(t *testing.T) {
+	handler := &fakeHandler{
+		acquire: func(ctx context.Context, w *MessageWriter, req *URIAcquire) error {
+			// Fails, which must abort this acquire.
+			w.Send(URIStart{URI: req.URI})
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	stdinreader, stdinwriter := io.Pipe()
+	defer stdinwriter.Close()
+	server := NewServer(handler, bufio.NewReader(stdinreader), &brokenWriter{n: 1})
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.Serve(context.Background())
+	}()
+
+	NewAptMessageWriter(stdinwriter).Send(URIAcquire{URI: "fake://uri", Filename: "/path/to/file"})
+	if err := <-errChan; !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("failed, expected io.ErrClosedPipe, got %v", err)
+	}
+}
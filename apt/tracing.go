@@ -0,0 +1,370 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The tracing here follows OpenTelemetry: spans are exported to a collector
+// with OTLP over HTTP, in its JSON encoding, and the trace is propagated in
+// W3C Trace Context headers.
+
+const (
+	// traceServiceName identifies the method in exported spans.
+	traceServiceName = "artifact-registry-apt-transport"
+	// traceparentEnv and tracestateEnv continue a trace from the process
+	// which ran apt, such as a deploy pipeline.
+	traceparentEnv = "TRACEPARENT"
+	tracestateEnv  = "TRACESTATE"
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+	statusCodeError  = 2
+)
+
+type traceID [16]byte
+type spanID [8]byte
+
+// spanContext identifies a span within its trace.
+type spanContext struct {
+	traceID traceID
+	spanID  spanID
+	// state is the vendor-specific W3C tracestate, passed on unchanged.
+	state string
+}
+
+// traceparent formats `sc` as a W3C traceparent header, sampled.
+func (sc spanContext) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", sc.traceID, sc.spanID)
+}
+
+// parseTraceparent parses a W3C traceparent header of version 00.
+func parseTraceparent(s string) (spanContext, error) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 2*len(sc.traceID) || len(parts[2]) != 2*len(sc.spanID) || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	_, traceErr := hex.Decode(sc.traceID[:], []byte(parts[1]))
+	_, spanErr := hex.Decode(sc.spanID[:], []byte(parts[2]))
+	if traceErr != nil || spanErr != nil || sc.traceID == (traceID{}) || sc.spanID == (spanID{}) {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	return sc, nil
+}
+
+// span is an operation within a trace. A nil *span, as started by a nil
+// *tracer, does nothing, so callers needn't check whether tracing is on.
+type span struct {
+	tracer *tracer
+	name   string
+	kind   int
+	spanContext
+	parent     spanID
+	start, end time.Time
+	attrs      []slog.Attr
+	err        error
+}
+
+// setAttrs adds attributes to the span.
+func (s *span) setAttrs(attrs ...slog.Attr) {
+	if s != nil {
+		s.attrs = append(s.attrs, attrs...)
+	}
+}
+
+// finish ends the span, recording `err` as its status if not nil.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end, s.err = time.Now(), err
+	s.tracer.record(s)
+}
+
+// spanExporter sends finished spans to wherever they are collected.
+type spanExporter interface {
+	export(ctx context.Context, spans []*span) error
+}
+
+// spanBatchSize is the number of finished spans which are exported together
+// during a session, rather than holding them all until it ends.
+const spanBatchSize = 256
+
+// tracer creates spans, and holds them once finished until they are
+// exported, in batches by flushBatch and then by flush at the end of the
+// session. A nil *tracer creates no spans.
+type tracer struct {
+	exporter spanExporter
+	// root is the parent of spans started without one, from TRACEPARENT.
+	root *spanContext
+
+	mu       sync.Mutex
+	finished []*span
+}
+
+// newTracer returns a tracer exporting to `exporter`, continuing the trace
+// described by `environ`, the environment, if any. An invalid TRACEPARENT is
+// reported, and otherwise ignored.
+func newTracer(exporter spanExporter, environ []string) (*tracer, error) {
+	t := &tracer{exporter: exporter}
+	var parent, state string
+	for _, kv := range environ {
+		switch name, value, _ := strings.Cut(kv, "="); name {
+		case traceparentEnv:
+			parent = value
+		case tracestateEnv:
+			state = value
+		}
+	}
+	if parent == "" {
+		return t, nil
+	}
+	sc, err := parseTraceparent(parent)
+	if err != nil {
+		return t, err
+	}
+	sc.state = state
+	t.root = &sc
+	return t, nil
+}
+
+type spanKey struct{}
+
+// spanFromContext returns the span `ctx` is within, if any.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// start starts a span named `name` within the span of `ctx`, returning a
+// context within the new span.
+func (t *tracer) start(ctx context.Context, name string, kind int, attrs ...slog.Attr) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: attrs}
+	switch parent := spanFromContext(ctx); {
+	case parent != nil:
+		s.traceID, s.parent, s.state = parent.traceID, parent.spanID, parent.state
+	case t.root != nil:
+		s.traceID, s.parent, s.state = t.root.traceID, t.root.spanID, t.root.state
+	default:
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startAt is start for a span which began at `start`, observed after the
+// fact.
+func (t *tracer) startAt(ctx context.Context, name string, start time.Time, attrs ...slog.Attr) *span {
+	_, s := t.start(ctx, name, spanKindInternal, attrs...)
+	if s != nil {
+		s.start = start
+	}
+	return s
+}
+
+func (t *tracer) record(s *span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finished = append(t.finished, s)
+}
+
+// flush exports the finished spans.
+func (t *tracer) flush(ctx context.Context) error {
+	return t.export(ctx, 1)
+}
+
+// flushBatch exports the finished spans if there are at least spanBatchSize
+// of them.
+func (t *tracer) flushBatch(ctx context.Context) error {
+	return t.export(ctx, spanBatchSize)
+}
+
+// export exports the finished spans if there are at least `atLeast` of them.
+// They are dropped if the export fails.
+func (t *tracer) export(ctx context.Context, atLeast int) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	if len(t.finished) < atLeast {
+		t.mu.Unlock()
+		return nil
+	}
+	spans := t.finished
+	t.finished = nil
+	t.mu.Unlock()
+	if err := t.exporter.export(ctx, spans); err != nil {
+		return fmt.Errorf("failed to export %d spans: %v", len(spans), err)
+	}
+	return nil
+}
+
+// injectTraceHeaders adds W3C Trace Context headers for the span of `ctx` to
+// `header`.
+func injectTraceHeaders(ctx context.Context, header http.Header) {
+	s := spanFromContext(ctx)
+	if s == nil {
+		return
+	}
+	header.Set("Traceparent", s.traceparent())
+	if s.state != "" {
+		header.Set("Tracestate", s.state)
+	}
+}
+
+// connectionTrace records a span for obtaining the connection for each
+// request in the span of `ctx`.
+func (t *tracer) connectionTrace(ctx context.Context) *httptrace.ClientTrace {
+	var start time.Time
+	return &httptrace.ClientTrace{
+		GetConn: func(string) { start = time.Now() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			s := t.startAt(ctx, "connect", start,
+				slog.String("net.peer.address", info.Conn.RemoteAddr().String()),
+				slog.Bool("reused", info.Reused))
+			s.finish(nil)
+		},
+	}
+}
+
+// openTracer starts tracing to the configured Trace-Endpoint, flushing any
+// spans for the previous one.
+func (m *Method) openTracer() error {
+	endpoint := m.config.traceEndpoint
+	if endpoint == m.traceEndpoint {
+		return nil
+	}
+	flushErr := m.tracer.flush(context.Background())
+	m.tracer, m.traceEndpoint = nil, endpoint
+	if endpoint == "" {
+		return flushErr
+	}
+	tracer, err := newTracer(otlpExporter{endpoint: endpoint}, os.Environ())
+	m.tracer = tracer
+	return errors.Join(flushErr, err)
+}
+
+// otlpExporter posts spans to an OTLP/HTTP collector, such as
+// http://localhost:4318/v1/traces.
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (e otlpExporter) export(ctx context.Context, spans []*span) error {
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := e.client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with code %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// otlpRequest returns the ExportTraceServiceRequest for `spans`, to be
+// encoded as JSON.
+func otlpRequest(spans []*span) map[string]any {
+	encoded := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		e := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parent != (spanID{}) {
+			e["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if s.state != "" {
+			e["traceState"] = s.state
+		}
+		if s.err != nil {
+			e["status"] = map[string]any{"code": statusCodeError, "message": s.err.Error()}
+		}
+		encoded = append(encoded, e)
+	}
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes([]slog.Attr{slog.String("service.name", traceServiceName)}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": traceServiceName},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs []slog.Attr) []any {
+	encoded := make([]any, 0, len(attrs))
+	for _, a := range attrs {
+		var value map[string]any
+		switch v := a.Value.Resolve(); v.Kind() {
+		case slog.KindBool:
+			value = map[string]any{"boolValue": v.Bool()}
+		case slog.KindInt64:
+			value = map[string]any{"intValue": strconv.FormatInt(v.Int64(), 10)}
+		case slog.KindFloat64:
+			value = map[string]any{"doubleValue": v.Float64()}
+		default:
+			value = map[string]any{"stringValue": v.String()}
+		}
+		encoded = append(encoded, map[string]any{"key": a.Key, "value": value})
+	}
+	return encoded
+}
@@ -0,0 +1,225 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// memoryExporter keeps exported spans for inspection.
+type memoryExporter struct {
+	spans []*span
+}
+
+func (e *memoryExporter) export(_ context.Context, spans []*span) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	var tests = []struct {
+		traceparent string
+		valid       bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"garbage", false},
+	}
+	for _, tt := range tests {
+		sc, err := parseTraceparent(tt.traceparent)
+		if (err == nil) != tt.valid {
+			t.Errorf("%q failed, expected valid %v got: %v", tt.traceparent, tt.valid, err)
+		}
+		if err == nil && sc.traceparent()[:len(tt.traceparent)-3] != tt.traceparent[:len(tt.traceparent)-3] {
+			t.Errorf("%q failed, got: %s", tt.traceparent, sc.traceparent())
+		}
+	}
+}
+
+func TestHandleAcquireTracing(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer, err := newTracer(exporter, []string{
+		"TRACEPARENT=00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"TRACESTATE=vendor=value",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests []*http.Request
+	method := &Method{
+		config: &aptMethodConfig{},
+		writer: NewAptMessageWriter(io.Discard),
+		client: fakeHTTPClient{requests: &requests},
+		dl:     fakeDownloader{},
+		tracer: tracer,
+	}
+	if err := method.handleAcquire(context.Background(), &URIAcquire{URI: "ar+https://fake.uri/file", Filename: "/path/to/file"}); err != nil {
+		t.Fatalf("handleAcquire failed: %v", err)
+	}
+	if err := tracer.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := make(map[string]*span)
+	for _, s := range exporter.spans {
+		spans[s.name] = s
+	}
+	acquire, get, transfer := spans["acquire"], spans["GET"], spans["transfer"]
+	if acquire == nil || get == nil || transfer == nil {
+		t.Fatalf("failed, expected acquire, GET and transfer spans, got %v", exporter.spans)
+	}
+	if got := fmt.Sprintf("%x/%x", acquire.traceID, acquire.parent); got != "4bf92f3577b34da6a3ce929d0e0e4736/00f067aa0ba902b7" {
+		t.Errorf("failed, expected acquire to continue the trace from the environment, got %s", got)
+	}
+	if get.parent != acquire.spanID || transfer.parent != acquire.spanID {
+		t.Errorf("failed, expected spans within acquire")
+	}
+	if len(requests) != 1 {
+		t.Fatalf("failed, expected 1 request, got %d", len(requests))
+	}
+	if got := requests[0].Header.Get("Traceparent"); got != get.traceparent() {
+		t.Errorf("failed, expected: traceparent %s got: %s", get.traceparent(), got)
+	}
+	if got := requests[0].Header.Get("Tracestate"); got != "vendor=value" {
+		t.Errorf("failed, expected: tracestate vendor=value got: %s", got)
+	}
+}
+
+func TestHandleAcquireTracingRedactsError(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer, _ := newTracer(exporter, nil)
+	method := &Method{
+		config: &aptMethodConfig{},
+		writer: NewAptMessageWriter(io.Discard),
+		client: fakeHTTPClient{err: &url.Error{
+			Op:  "Get",
+			URL: "https://storage.googleapis.com/b/o?X-Goog-Signature=signature-secret",
+			Err: errors.New("connection reset by peer"),
+		}},
+		dl:     fakeDownloader{},
+		tracer: tracer,
+	}
+	method.handleAcquire(context.Background(), &URIAcquire{URI: "ar+https://fake.uri/file", Filename: "/path/to/file"})
+	tracer.flush(context.Background())
+
+	if len(exporter.spans) == 0 {
+		t.Fatal("failed, expected spans")
+	}
+	for _, s := range exporter.spans {
+		if s.err == nil || strings.Contains(s.err.Error(), "signature-secret") {
+			t.Errorf("failed, expected a redacted error on span %s, got %v", s.name, s.err)
+		}
+	}
+}
+
+func TestHandleAcquireNoTracing(t *testing.T) {
+	var requests []*http.Request
+	method := &Method{
+		config: &aptMethodConfig{},
+		writer: NewAptMessageWriter(io.Discard),
+		client: fakeHTTPClient{requests: &requests},
+		dl:     fakeDownloader{},
+	}
+	if err := method.handleAcquire(context.Background(), &URIAcquire{URI: "ar+https://fake.uri/file", Filename: "/path/to/file"}); err != nil {
+		t.Fatalf("handleAcquire failed: %v", err)
+	}
+	if got := requests[0].Header.Get("Traceparent"); got != "" {
+		t.Errorf("failed, expected no traceparent without tracing, got %s", got)
+	}
+}
+
+func TestTracerFlushBatch(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer, _ := newTracer(exporter, nil)
+	ctx := context.Background()
+	for i := 0; i < spanBatchSize; i++ {
+		if err := tracer.flushBatch(ctx); err != nil || len(exporter.spans) != 0 {
+			t.Fatalf("failed, expected no export of %d spans, got %d %v", i, len(exporter.spans), err)
+		}
+		_, s := tracer.start(ctx, "acquire", spanKindInternal)
+		s.finish(nil)
+	}
+	if err := tracer.flushBatch(ctx); err != nil || len(exporter.spans) != spanBatchSize {
+		t.Errorf("failed, expected: %d spans exported got: %d %v", spanBatchSize, len(exporter.spans), err)
+	}
+	if len(tracer.finished) != 0 {
+		t.Errorf("failed, expected exported spans to be released, got %d", len(tracer.finished))
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var request map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	tracer, _ := newTracer(otlpExporter{endpoint: server.URL + "/v1/traces"}, nil)
+	ctx, parent := tracer.start(context.Background(), "acquire", spanKindInternal)
+	_, child := tracer.start(ctx, "GET", spanKindClient)
+	child.finish(errors.New("code 503"))
+	parent.finish(nil)
+	if err := tracer.flush(context.Background()); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	resourceSpans := request["resourceSpans"].([]any)[0].(map[string]any)
+	spans := resourceSpans["scopeSpans"].([]any)[0].(map[string]any)["spans"].([]any)
+	if len(spans) != 2 {
+		t.Fatalf("failed, expected 2 spans, got %v", spans)
+	}
+	get := spans[0].(map[string]any)
+	expected := map[string]any{
+		"name":         "GET",
+		"kind":         float64(spanKindClient),
+		"traceId":      fmt.Sprintf("%x", parent.traceID),
+		"parentSpanId": fmt.Sprintf("%x", parent.spanID),
+		"status":       map[string]any{"code": float64(statusCodeError), "message": "code 503"},
+	}
+	for key, value := range expected {
+		if fmt.Sprint(get[key]) != fmt.Sprint(value) {
+			t.Errorf("failed, expected: %s=%v got: %v", key, value, get[key])
+		}
+	}
+
+	failing := httptest.NewServer(http.NotFoundHandler())
+	defer failing.Close()
+	tracer, _ = newTracer(otlpExporter{endpoint: failing.URL + "/v1/traces"}, nil)
+	_, s := tracer.start(context.Background(), "acquire", spanKindInternal)
+	s.finish(nil)
+	if err := tracer.flush(context.Background()); err == nil {
+		t.Errorf("failed, expected an error from a failing collector")
+	}
+}
@@ -0,0 +1,219 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// TypedMessage is implemented by the structs below, each of which represents
+// one kind of Apt message. Struct fields are mapped to message fields with an
+// `apt:"Name"` tag; the "omitempty" option skips zero values when marshaling.
+// Supported field types are string, bool, int64 and []string, where a slice
+// holds every value of a repeated field.
+type TypedMessage interface {
+	header() (code int, description string)
+}
+
+// Capabilities is sent by the method on startup to describe itself.
+type Capabilities struct {
+	Version        string `apt:"Version"`
+	SingleInstance bool   `apt:"Single-Instance,omitempty"`
+	Pipeline       bool   `apt:"Pipeline,omitempty"`
+	SendConfig     bool   `apt:"Send-Config,omitempty"`
+	LocalOnly      bool   `apt:"Local-Only,omitempty"`
+	NeedsCleanup   bool   `apt:"Needs-Cleanup,omitempty"`
+	Removable      bool   `apt:"Removable,omitempty"`
+	AuxRequests    bool   `apt:"AuxRequests,omitempty"`
+	SendURIEncoded bool   `apt:"Send-URI-Encoded,omitempty"`
+}
+
+// Log is a debug message, shown by apt when method debugging is enabled.
+type Log struct {
+	Message string `apt:"Message"`
+}
+
+// Status reports progress on a URI.
+type Status struct {
+	URI     string `apt:"URI,omitempty"`
+	Message string `apt:"Message"`
+}
+
+// Redirect asks apt to fetch URI from NewURI instead.
+type Redirect struct {
+	URI    string `apt:"URI"`
+	NewURI string `apt:"New-URI"`
+}
+
+// URIStart reports that a download has started.
+type URIStart struct {
+	URI          string `apt:"URI"`
+	Size         int64  `apt:"Size,omitempty"`
+	LastModified string `apt:"Last-Modified,omitempty"`
+	ResumePoint  int64  `apt:"Resume-Point"`
+}
+
+// URIDone reports that a download has completed.
+type URIDone struct {
+	URI          string `apt:"URI"`
+	Filename     string `apt:"Filename"`
+	LastModified string `apt:"Last-Modified,omitempty"`
+	IMSHit       bool   `apt:"IMS-Hit,omitempty"`
+	Size         int64  `apt:"Size,omitempty"`
+	MD5Hash      string `apt:"MD5-Hash,omitempty"`
+	SHA256Hash   string `apt:"SHA256-Hash,omitempty"`
+	SHA512Hash   string `apt:"SHA512-Hash,omitempty"`
+}
+
+// URIFailure reports that a download has failed.
+type URIFailure struct {
+	URI        string `apt:"URI"`
+	Message    string `apt:"Message"`
+	FailReason string `apt:"FailReason,omitempty"`
+	Transient  bool   `apt:"Transient,omitempty"`
+}
+
+// GeneralFailure reports a failure of the method itself. apt stops using
+// the method after receiving it.
+type GeneralFailure struct {
+	Message string `apt:"Message"`
+}
+
+// URIAcquire is sent by apt to request a download.
+type URIAcquire struct {
+	URI                      string `apt:"URI"`
+	Filename                 string `apt:"Filename"`
+	LastModified             string `apt:"Last-Modified,omitempty"`
+	IndexFile                bool   `apt:"Index-File,omitempty"`
+	FailIgnore               bool   `apt:"Fail-Ignore,omitempty"`
+	MaximumSize              int64  `apt:"Maximum-Size,omitempty"`
+	ExpectedMD5              string `apt:"Expected-MD5Sum,omitempty"`
+	ExpectedSHA1             string `apt:"Expected-SHA1,omitempty"`
+	ExpectedSHA256           string `apt:"Expected-SHA256,omitempty"`
+	ExpectedSHA512           string `apt:"Expected-SHA512,omitempty"`
+	ExpectedChecksumFileSize string `apt:"Expected-Checksum-FileSize,omitempty"`
+	TargetSite               string `apt:"Target-Site,omitempty"`
+	TargetRepoURI            string `apt:"Target-Repo-URI,omitempty"`
+	TargetBaseURI            string `apt:"Target-Base-URI,omitempty"`
+	TargetComponent          string `apt:"Target-Component,omitempty"`
+	TargetRelease            string `apt:"Target-Release,omitempty"`
+}
+
+// Configuration is sent by apt, if requested in Capabilities, with the
+// complete apt configuration as "Key=Value" items.
+type Configuration struct {
+	ConfigItems []string `apt:"Config-Item,omitempty"`
+}
+
+func (Capabilities) header() (int, string)   { return 100, "Capabilities" }
+func (Log) header() (int, string)            { return 101, "Log" }
+func (Status) header() (int, string)         { return 102, "Status" }
+func (Redirect) header() (int, string)       { return 103, "Redirect" }
+func (URIStart) header() (int, string)       { return 200, "URI Start" }
+func (URIDone) header() (int, string)        { return 201, "URI Done" }
+func (URIFailure) header() (int, string)     { return 400, "URI Failure" }
+func (GeneralFailure) header() (int, string) { return 401, "General Failure" }
+func (URIAcquire) header() (int, string)     { return 600, "URI Acquire" }
+func (Configuration) header() (int, string)  { return 601, "Configuration" }
+
+// parseTag splits an `apt` struct tag into the field name and whether the
+// omitempty option is set.
+func parseTag(tag string) (string, bool) {
+	name, opts, _ := strings.Cut(tag, ",")
+	return name, opts == "omitempty"
+}
+
+// Marshal converts a typed message into a Message. It panics if the struct
+// has a field of an unsupported type.
+func Marshal(v TypedMessage) *Message {
+	code, description := v.header()
+	m := &Message{code: code, description: description}
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		tag, ok := rt.Field(i).Tag.Lookup("apt")
+		if !ok {
+			continue
+		}
+		key, omitEmpty := parseTag(tag)
+		fv := rv.Field(i)
+		if omitEmpty && fv.IsZero() {
+			continue
+		}
+		switch fv.Kind() {
+		case reflect.String:
+			m.Add(key, fv.String())
+		case reflect.Bool:
+			m.Add(key, strconv.FormatBool(fv.Bool()))
+		case reflect.Int64:
+			m.Add(key, strconv.FormatInt(fv.Int(), 10))
+		case reflect.Slice:
+			for j := 0; j < fv.Len(); j++ {
+				m.Add(key, fv.Index(j).String())
+			}
+		default:
+			panic(fmt.Sprintf("apt: unsupported field type %v for %s", fv.Kind(), key))
+		}
+	}
+	return m
+}
+
+// Unmarshal fills the typed message pointed to by `v` from `m`. Fields
+// missing from the message are left unchanged. It returns an error if the
+// message code doesn't match, or a value can't be parsed.
+func Unmarshal(m *Message, v TypedMessage) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("apt: Unmarshal requires a non-nil pointer, got %T", v)
+	}
+	code, description := v.header()
+	if m.code != code {
+		return fmt.Errorf("cannot unmarshal message %d %s into %d %s", m.code, m.description, code, description)
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		tag, ok := rt.Field(i).Tag.Lookup("apt")
+		if !ok {
+			continue
+		}
+		key, _ := parseTag(tag)
+		values := m.Values(key)
+		if len(values) == 0 {
+			continue
+		}
+		fv := rv.Field(i)
+		switch fv.Kind() {
+		case reflect.String:
+			fv.SetString(values[0])
+		case reflect.Bool:
+			fv.SetBool(stringToBool(values[0]))
+		case reflect.Int64:
+			n, err := strconv.ParseInt(values[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("malformed field %s: %q is not an integer", key, values[0])
+			}
+			fv.SetInt(n)
+		case reflect.Slice:
+			fv.Set(reflect.ValueOf(append([]string(nil), values...)))
+		default:
+			return fmt.Errorf("apt: unsupported field type %v for %s", fv.Kind(), key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	var tests = []struct {
+		message  TypedMessage
+		expected string
+	}{
+		{
+			Capabilities{Version: "1.0", SendConfig: true, SendURIEncoded: true},
+			"100 Capabilities\nVersion: 1.0\nSend-Config: true\nSend-URI-Encoded: true\n\n",
+		},
+		{
+			&Status{Message: "Connecting"},
+			"102 Status\nMessage: Connecting\n\n",
+		},
+		{
+			// Resume-Point is not omitempty.
+			URIStart{URI: "ar+https://fake.uri/file", Size: 100},
+			"200 URI Start\nURI: ar+https://fake.uri/file\nSize: 100\nResume-Point: 0\n\n",
+		},
+		{
+			URIDone{URI: "ar+https://fake.uri/file", Filename: "/path/to/file", Size: 100, MD5Hash: "abc", SHA256Hash: "def"},
+			"201 URI Done\nURI: ar+https://fake.uri/file\nFilename: /path/to/file\nSize: 100\nMD5-Hash: abc\nSHA256-Hash: def\n\n",
+		},
+		{
+			URIFailure{URI: "ar+https://fake.uri/file", Message: "not found", FailReason: "HttpError404"},
+			"400 URI Failure\nURI: ar+https://fake.uri/file\nMessage: not found\nFailReason: HttpError404\n\n",
+		},
+		{
+			Configuration{ConfigItems: []string{"a=1", "b=2"}},
+			"601 Configuration\nConfig-Item: a=1\nConfig-Item: b=2\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		if res := Marshal(tt.message).String(); res != tt.expected {
+			t.Errorf("failed, expected:\n%q\ngot:\n%q", tt.expected, res)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	msg := &Message{
+		code:        600,
+		description: "URI Acquire",
+		fields: []field{
+			{"uri", "ar+https://fake.uri/file"},
+			{"Filename", "/path/to/file"},
+			{"Index-File", "true"},
+			{"Maximum-Size", "1024"},
+			{"Expected-SHA256", "abc"},
+			{"Target-Site", "fake.uri"},
+			{"Unknown-Field", "ignored"},
+		},
+	}
+	expected := URIAcquire{
+		URI:            "ar+https://fake.uri/file",
+		Filename:       "/path/to/file",
+		IndexFile:      true,
+		MaximumSize:    1024,
+		ExpectedSHA256: "abc",
+		TargetSite:     "fake.uri",
+	}
+	var res URIAcquire
+	if err := Unmarshal(msg, &res); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if res != expected {
+		t.Errorf("failed, expected: %+v got: %+v", expected, res)
+	}
+
+	config := &Message{code: 601, description: "Configuration", fields: []field{{"Config-Item", "a=1"}, {"Config-Item", "b=2"}}}
+	var configRes Configuration
+	if err := Unmarshal(config, &configRes); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if !reflect.DeepEqual(configRes.ConfigItems, []string{"a=1", "b=2"}) {
+		t.Errorf("failed, expected config items [a=1 b=2] got: %q", configRes.ConfigItems)
+	}
+}
+
+func TestUnmarshalFail(t *testing.T) {
+	var tests = []struct {
+		message Message
+		target  TypedMessage
+	}{
+		{
+			// Wrong message code.
+			Message{code: 601, description: "Configuration"},
+			&URIAcquire{},
+		},
+		{
+			// Malformed integer.
+			Message{code: 600, description: "URI Acquire", fields: []field{{"Maximum-Size", "big"}}},
+			&URIAcquire{},
+		},
+		{
+			// Not a pointer.
+			Message{code: 600, description: "URI Acquire"},
+			URIAcquire{},
+		},
+	}
+
+	for idx, tt := range tests {
+		if err := Unmarshal(&tt.message, tt.target); err == nil {
+			t.Errorf("validation failed test %d", idx)
+		}
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	var tests = []TypedMessage{
+		&Capabilities{Version: "1.0", SingleInstance: true, Pipeline: true, LocalOnly: true},
+		&Log{Message: "some log message"},
+		&Redirect{URI: "ar+https://fake.uri/file", NewURI: "https://other.uri/file"},
+		&URIDone{URI: "ar+https://fake.uri/file", Filename: "/path/to/file", IMSHit: true},
+		&URIFailure{URI: "ar+https://fake.uri/file", Message: "failed", Transient: true},
+		&GeneralFailure{Message: "failed"},
+	}
+
+	for _, tt := range tests {
+		res := reflect.New(reflect.TypeOf(tt).Elem()).Interface().(TypedMessage)
+		if err := Unmarshal(Marshal(tt), res); err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+		if !reflect.DeepEqual(res, tt) {
+			t.Errorf("failed, expected: %+v got: %+v", tt, res)
+		}
+	}
+}
@@ -19,13 +19,20 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/GoogleCloudPlatform/artifact-registry-apt-transport/apt"
 )
 
 func main() {
+	// apt interrupts its methods when it is itself interrupted, and terminates
+	// them when it is done with them.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	apt := apt.NewAptMethod(bufio.NewReader(os.Stdin), os.Stdout)
-	err := apt.Run(context.Background())
+	err := apt.Run(ctx)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		os.Exit(100)
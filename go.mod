@@ -4,4 +4,4 @@ go 1.23.0
 
 require golang.org/x/oauth2 v0.27.0
 
-require cloud.google.com/go/compute/metadata v0.3.0 // indirect
+require cloud.google.com/go/compute/metadata v0.3.0